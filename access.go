@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Error code reported to clients connecting from a network they are not allowed from
+const errCodeForbidden = "forbidden"
+
+var errForbidden = &codedError{errCodeForbidden, "forbidden"}
+
+// Networks a client may connect from. Denied networks take precedence, and when
+// allowed networks are listed the client must belong to one of them. A nil list
+// lets everyone in.
+type accessList struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+func newAccessList(allowed []string, denied []string) (*accessList, error) {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil, nil
+	}
+	a := &accessList{}
+	var err error
+	a.allowed, err = parseNetworks(allowed)
+	if err != nil {
+		return nil, err
+	}
+	a.denied, err = parseNetworks(denied)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Parse CIDR networks, a bare address stands for itself
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	var parsed []*net.IPNet
+	for _, n := range networks {
+		if !strings.Contains(n, "/") {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", n)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			parsed = append(parsed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", n)
+		}
+		parsed = append(parsed, network)
+	}
+	return parsed, nil
+}
+
+// Is a client at the given "host:port" address allowed. Clients whose address cannot
+// be determined are only let in when no allowed networks are listed.
+func (a *accessList) permits(addr string) bool {
+	if a == nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return len(a.allowed) == 0
+	}
+
+	for _, network := range a.denied {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allowed) == 0 {
+		return true
+	}
+	for _, network := range a.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Turn away connections from networks that are not allowed, before any command is read
+func (p *program) admit(conn net.Conn) bool {
+	client := conn.RemoteAddr().String()
+	if p.config().access.permits(client) {
+		return true
+	}
+	log.Println("Rejected connection from", client+": forbidden")
+	newResponder(conn).error(errCodeForbidden, "forbidden")
+	conn.Close()
+	return false
+}
+
+// Check the networks a modem can be controlled from, on top of the global lists
+func checkModemAccess(modem *Modem, client string) error {
+	if modem.access.permits(client) {
+		return nil
+	}
+	log.Println("Rejected", modem.Name, "for", client+": forbidden")
+	return errForbidden
+}
+
+// Apply the global network lists to the HTTP API
+func (p *program) restrictNetworks(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !p.config().access.permits(req.RemoteAddr) {
+			log.Println("Rejected HTTP request from", req.RemoteAddr+": forbidden")
+			writeHTTPError(w, http.StatusForbidden, errCodeForbidden, "forbidden")
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccessListPermits(t *testing.T) {
+	a, err := newAccessList([]string{"192.168.1.0/24", "10.0.0.5", "fd00::/8"}, []string{"192.168.1.66"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"192.168.1.10:5000": true,
+		"192.168.1.66:5000": false,
+		"10.0.0.5:5000":     true,
+		"10.0.0.6:5000":     false,
+		"[fd00::1]:5000":    true,
+		"[2001:db8::1]:80":  false,
+		"pipe":              false,
+	}
+	for addr, want := range cases {
+		if got := a.permits(addr); got != want {
+			t.Errorf("permits(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestAccessListDeniedOnly(t *testing.T) {
+	a, err := newAccessList(nil, []string{"172.16.0.0/12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.permits("172.16.4.1:80") || !a.permits("192.168.1.1:80") || !a.permits("pipe") {
+		t.Fatal("unexpected result for denied only list")
+	}
+
+	var open *accessList
+	if !open.permits("172.16.4.1:80") {
+		t.Fatal("empty list should permit everyone")
+	}
+}
+
+func TestAccessListInvalid(t *testing.T) {
+	_, err := newAccessList([]string{"192.168.1.0/33"}, nil)
+	if err == nil {
+		t.Fatal("expected error for invalid network")
+	}
+	_, err = newAccessList(nil, []string{"hotspot"})
+	if err == nil {
+		t.Fatal("expected error for invalid address")
+	}
+}
+
+// Parse the network lists as checkConfig does
+func compileAccessLists(t *testing.T, p *program) {
+	t.Helper()
+	var err error
+	p.access, err = newAccessList(p.AllowedNetworks, p.DeniedNetworks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, modem := range p.Modems {
+		modem.access, err = newAccessList(modem.AllowedNetworks, modem.DeniedNetworks)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A connection reporting a chosen remote address
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestAdmitRejectsForbiddenNetwork(t *testing.T) {
+	p := newTestProgram()
+	p.AllowedNetworks = []string{"192.168.1.0/24"}
+	compileAccessLists(t, p)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := addrConn{server, &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 5000}}
+	go p.admit(conn)
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil || line != "ERROR forbidden\n" {
+		t.Fatalf("expected forbidden, got %q, %v", line, err)
+	}
+
+	conn.remote = &net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5000}
+	if !p.admit(conn) {
+		t.Fatal("expected connection from allowed network to be admitted")
+	}
+}
+
+func TestModemNetworksOverride(t *testing.T) {
+	p := newTestProgram()
+	p.Modems[1].AllowedNetworks = []string{"192.168.1.0/24"}
+	compileAccessLists(t, p)
+
+	conn, r, _ := startTestSession(t, p)
+	send(conn, "start IC705HF\n")
+	expectLines(t, conn, r, "ERROR forbidden")
+	if p.sessions.forModem(p.Modems[1]) != nil {
+		t.Fatal("session should not have been opened")
+	}
+}
+
+func TestHTTPForbiddenNetwork(t *testing.T) {
+	p := newTestProgram()
+	p.DeniedNetworks = []string{"192.0.2.0/24"}
+	compileAccessLists(t, p)
+
+	// httptest requests come from 192.0.2.1
+	w := httptest.NewRecorder()
+	p.newHTTPHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Arguments of the modem and CAT control executables. The configuration gives them
+// either as a JSON array, each element being one argument, or as a string split the
+// way a POSIX shell does, see split. Arrays are kept quoted so both forms are
+// handled alike.
+type CommandArgs string
+
+func (a *CommandArgs) UnmarshalJSON(data []byte) error {
+	var list []string
+	if json.Unmarshal(data, &list) == nil {
+		*a = CommandArgs(quoteArgs(list))
+		return nil
+	}
+	var s string
+	if json.Unmarshal(data, &s) != nil {
+		return errors.New("Args must be a string or an array of strings")
+	}
+	*a = CommandArgs(s)
+	return nil
+}
+
+// Join arguments into a string split back into the same arguments
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\") {
+			quoted[i] = arg
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Split the arguments on whitespace. Single quotes keep everything up to the next
+// single quote as is, double quotes keep whitespace and single quotes. A backslash
+// only escapes whitespace or a quote, within double quotes only a double quote. Any
+// other backslash is kept so Windows paths, device names such as \\.\COM10 and UNC
+// paths need no quoting.
+//
+// A single unquoted absolute path to an .exe is kept whole even if it contains
+// spaces, it is how VARA is usually run with Wine: "Args": "/home/pi/.wine/drive_c/VARA FM/VARAFM.exe".
+func (a CommandArgs) split() ([]string, error) {
+	s := strings.TrimSpace(string(a))
+	if isLegacyExePath(s) {
+		return []string{s}, nil
+	}
+
+	var args []string
+	var arg strings.Builder
+	inArg := false // distinguishes an empty quoted argument from no argument
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			if !strings.ContainsRune(" \t\n'\"", c) || (quote == '"' && c != '"') {
+				arg.WriteRune('\\')
+			}
+			arg.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated " + string(quote) + " quote")
+	}
+	if escaped {
+		arg.WriteRune('\\')
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+func isLegacyExePath(s string) bool {
+	if strings.ContainsAny(s, `'"`) || !strings.HasSuffix(strings.ToLower(s), ".exe") {
+		return false
+	}
+	return strings.HasPrefix(s, "/") || (len(s) > 2 && s[1] == ':' && (s[2] == '\\' || s[2] == '/'))
+}
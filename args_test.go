@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandArgsSplit(t *testing.T) {
+	cases := []struct {
+		args CommandArgs
+		want []string
+	}{
+		{"", nil},
+		{"-m 3085 -r /dev/ic-705a", []string{"-m", "3085", "-r", "/dev/ic-705a"}},
+		{"-m  3085 \t-s 19200 ", []string{"-m", "3085", "-s", "19200"}},
+		{`-r "/dev/serial/by-id/usb-Icom IC-705"`, []string{"-r", "/dev/serial/by-id/usb-Icom IC-705"}},
+		{`-r '/dev/my radio' -C "serial_handshake=None"`, []string{"-r", "/dev/my radio", "-C", "serial_handshake=None"}},
+		{`-r /dev/my\ radio`, []string{"-r", "/dev/my radio"}},
+		{`"it's" 'say "hi"' "a\"b"`, []string{"it's", `say "hi"`, `a"b`}},
+		{`'' -v`, []string{"", "-v"}},
+		{`-r COM7 C:\hamlib\rigctld.conf`, []string{"-r", "COM7", `C:\hamlib\rigctld.conf`}},
+		{`-r \\.\COM10 -s 19200`, []string{"-r", `\\.\COM10`, "-s", "19200"}},
+		{`\\shack\vara\VARA.exe -v`, []string{`\\shack\vara\VARA.exe`, "-v"}},
+		{`"\\shack\VARA FM\VARAFM.exe" a\\b`, []string{`\\shack\VARA FM\VARAFM.exe`, `a\\b`}},
+		// Wine convention, a single unquoted path to VARA
+		{"/home/pi/.wine/drive_c/VARA FM/VARAFM.exe", []string{"/home/pi/.wine/drive_c/VARA FM/VARAFM.exe"}},
+		{`C:\VARA FM\VARAFM.exe`, []string{`C:\VARA FM\VARAFM.exe`}},
+		{`start /unix "/home/pi/.wine/drive_c/VARA FM/VARAFM.exe"`, []string{"start", "/unix", "/home/pi/.wine/drive_c/VARA FM/VARAFM.exe"}},
+	}
+	for _, c := range cases {
+		got, err := c.args.split()
+		if err != nil {
+			t.Errorf("split(%q): %v", c.args, err)
+			continue
+		}
+		if strings.Join(got, "|") != strings.Join(c.want, "|") || len(got) != len(c.want) {
+			t.Errorf("split(%q) = %q, want %q", c.args, got, c.want)
+		}
+	}
+
+	if _, err := CommandArgs(`-r "/dev/my radio`).split(); err == nil || err.Error() != `unterminated " quote` {
+		t.Fatalf("expected unterminated quote error, got %v", err)
+	}
+}
+
+func TestCommandArgsJSON(t *testing.T) {
+	var modem Modem
+	err := json.Unmarshal([]byte(`{"Args": ["/home/pi/.wine/drive_c/VARA FM/VARAFM.exe", "it's", "", "C:\\VARA\\VARA.exe"], "CatCtrl": {"Args": "-m 3085"}}`), &modem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := modem.Args.split()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/home/pi/.wine/drive_c/VARA FM/VARAFM.exe", "it's", "", `C:\VARA\VARA.exe`}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("unexpected args %q", got)
+	}
+	if modem.CatCtrl.Args != "-m 3085" {
+		t.Fatalf("unexpected CAT args %q", modem.CatCtrl.Args)
+	}
+
+	err = json.Unmarshal([]byte(`{"Args": 3085}`), &modem)
+	if err == nil || !strings.Contains(err.Error(), "Args must be a string or an array of strings") {
+		t.Fatalf("expected type error, got %v", err)
+	}
+}
+
+func TestStartWithSpacesInPaths(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "VARA FM")
+	p := newTestProgram()
+	modem := p.Modems[0]
+	modem.Cmd = "mkdir"
+	modem.Args = CommandArgs(quoteArgs([]string{"-p", filepath.Join(dir, "modem dir")}))
+	modem.CatCtrl.Cmd = "mkdir"
+	modem.CatCtrl.Args = CommandArgs(`-p "` + filepath.Join(dir, "cat dir") + `"`)
+
+	sess, err := p.openSession(modem, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	err = sess.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !FileExists(filepath.Join(dir, "modem dir")) || !FileExists(filepath.Join(dir, "cat dir")) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the paths with spaces to be passed as single arguments")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Commands accepted on the control port before the client authenticated
+var publicCommands = map[string]bool{
+	"version":   true,
+	"ping":      true,
+	"list":      true,
+	"proto":     true,
+	"challenge": true,
+	"auth":      true,
+}
+
+// Commands acting on other clients or on varanny itself
+var adminCommands = map[string]bool{
+	"sessions": true,
+	"kill":     true,
+	"reload":   true,
+}
+
+// Authentication state of a control port connection. When a Secret is configured
+// clients either send it with "auth <secret>" or, to keep it off the wire, request
+// a "challenge" and answer with "auth hmac <hex HMAC-SHA256 of the challenge keyed
+// with the secret>". Admin commands require the AdminSecret the same way, or any
+// authenticated client when there is none.
+type authState struct {
+	secret        string
+	adminSecret   string
+	challenge     string
+	authenticated bool
+	admin         bool
+}
+
+func newAuthState(secret string, adminSecret string) *authState {
+	return &authState{secret: secret, adminSecret: adminSecret, authenticated: secret == ""}
+}
+
+// Is the command allowed in the current state
+func (a *authState) allowed(verb string) bool {
+	if adminCommands[verb] {
+		return a.admin || (a.adminSecret == "" && a.authenticated)
+	}
+	return a.authenticated || publicCommands[verb]
+}
+
+// Generate a new random challenge, replacing any previous one
+func (a *authState) newChallenge() (string, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	a.challenge = hex.EncodeToString(nonce)
+	return a.challenge, nil
+}
+
+// Check the argument of an auth command. A challenge can only be answered once.
+func (a *authState) verify(argument string) bool {
+	if a.secret == "" && a.adminSecret == "" {
+		return true
+	}
+
+	matches := func(secret string) bool {
+		return secret != "" && secretEqual(argument, secret)
+	}
+	if strings.HasPrefix(argument, "hmac ") {
+		challenge := a.challenge
+		a.challenge = ""
+		answer := []byte(strings.ToLower(strings.TrimPrefix(argument, "hmac ")))
+		matches = func(secret string) bool {
+			return secret != "" && challenge != "" && hmac.Equal([]byte(computeAuthResponse(secret, challenge)), answer)
+		}
+	}
+
+	switch {
+	case matches(a.adminSecret):
+		a.authenticated, a.admin = true, true
+		return true
+	case matches(a.secret):
+		a.authenticated, a.admin = true, false
+		return true
+	}
+	a.authenticated, a.admin = a.secret == "", false
+	return false
+}
+
+// The expected answer to a challenge
+func computeAuthResponse(secret string, challenge string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(challenge))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func secretEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Hide secrets from the logs
+func redactCommand(command string) string {
+	if strings.HasPrefix(command, "auth ") {
+		return "auth ****"
+	}
+	return command
+}
+
+// The credential of an HTTP request, see authorizedHTTP
+func httpToken(req *http.Request) string {
+	token := req.URL.Query().Get("token")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return token
+}
+
+// HTTP clients authenticate with an "Authorization: Bearer <secret>" header or, for
+// EventSource which cannot set headers, a token query parameter
+func (p *program) authorizedHTTP(req *http.Request) bool {
+	conf := p.config()
+	if conf.Secret == "" {
+		return true
+	}
+	token := httpToken(req)
+	return secretEqual(token, conf.Secret) || (conf.AdminSecret != "" && secretEqual(token, conf.AdminSecret))
+}
+
+// Admin endpoints take the AdminSecret, or the Secret when there is none
+func (p *program) authorizedHTTPAdmin(req *http.Request) bool {
+	conf := p.config()
+	if conf.AdminSecret == "" {
+		return p.authorizedHTTP(req)
+	}
+	return secretEqual(httpToken(req), conf.AdminSecret)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestProgramWithSecret() *program {
+	p := newTestProgram()
+	p.Secret = "s3cret"
+	return p
+}
+
+func TestAuthOpenWithoutSecret(t *testing.T) {
+	conn, r, _ := startTestSession(t, newTestProgram())
+	send(conn, "config\n")
+	expectLines(t, conn, r, "OK")
+}
+
+func TestAuthUnauthenticatedLimited(t *testing.T) {
+	conn, r, _ := startTestSession(t, newTestProgramWithSecret())
+	send(conn, "version\nlist\nconfig\nstart IC705FM\n")
+	expectLines(t, conn, r,
+		"OK", version,
+		"OK", "IC705FM", "IC705HF",
+		"ERROR unauthorized",
+		"ERROR unauthorized")
+}
+
+func TestAuthToken(t *testing.T) {
+	conn, r, _ := startTestSession(t, newTestProgramWithSecret())
+	send(conn, "auth wrong\n")
+	expectLines(t, conn, r, "ERROR authentication failed")
+	send(conn, "auth s3cret\nconfig\n")
+	expectLines(t, conn, r, "OK", "OK")
+}
+
+func TestAuthChallengeResponse(t *testing.T) {
+	conn, r, _ := startTestSession(t, newTestProgramWithSecret())
+	send(conn, "challenge\n")
+	expectLines(t, conn, r, "OK")
+	challenge, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge = strings.TrimSuffix(challenge, "\n")
+	if len(challenge) != 32 {
+		t.Fatalf("unexpected challenge %q", challenge)
+	}
+
+	send(conn, "auth hmac "+computeAuthResponse("s3cret", challenge)+"\nconfig\n")
+	expectLines(t, conn, r, "OK", "OK")
+}
+
+func TestAuthChallengeSingleUse(t *testing.T) {
+	a := newAuthState("s3cret", "")
+	challenge, err := a.newChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := "hmac " + computeAuthResponse("wrong", challenge)
+	if a.verify(answer) {
+		t.Fatal("expected wrong secret to be rejected")
+	}
+	if a.verify("hmac " + computeAuthResponse("s3cret", challenge)) {
+		t.Fatal("expected a challenge to be answered only once")
+	}
+	if a.allowed("start") {
+		t.Fatal("expected start to require authentication")
+	}
+}
+
+func TestRedactCommand(t *testing.T) {
+	if got := redactCommand("auth s3cret"); strings.Contains(got, "s3cret") {
+		t.Fatalf("secret leaked in %q", got)
+	}
+	if got := redactCommand("start IC705FM"); got != "start IC705FM" {
+		t.Fatalf("unexpected %q", got)
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	h := newTestProgramWithSecret().newHTTPHandler()
+
+	if code := doHTTP(t, h, http.MethodGet, "/modems", nil); code != http.StatusOK {
+		t.Fatalf("expected modem list to be public, got %d", code)
+	}
+	if code := doHTTP(t, h, http.MethodGet, "/config", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized, got %d", code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/config", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected bearer token to be accepted, got %d", rec.Code)
+	}
+
+	if code := doHTTP(t, h, http.MethodGet, "/modems/IC705FM?token=s3cret", nil); code != http.StatusOK {
+		t.Fatalf("expected token parameter to be accepted, got %d", code)
+	}
+}
+
+func TestHTTPModemsHidesSessions(t *testing.T) {
+	p := newTestProgramWithSecret()
+	sess, err := p.openSession(p.Modems[0], "10.0.0.7:51234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	h := p.newHTTPHandler()
+
+	var states []modemState
+	doHTTP(t, h, http.MethodGet, "/modems", &states)
+	if !states[0].Running || states[0].Session != nil {
+		t.Fatalf("expected the session to be hidden without the secret, got %+v", states[0])
+	}
+	doHTTP(t, h, http.MethodGet, "/modems?token=s3cret", &states)
+	if states[0].Session == nil || states[0].Session.Client != "10.0.0.7:51234" {
+		t.Fatalf("expected the session with the secret, got %+v", states[0])
+	}
+}
+
+func TestAuthAdminCommands(t *testing.T) {
+	p := newTestProgramWithSecret()
+	p.AdminSecret = "4dmin"
+
+	conn, r, _ := startTestSession(t, p)
+	send(conn, "auth s3cret\nsessions\nkill 1\n")
+	expectLines(t, conn, r, "OK", "ERROR unauthorized", "ERROR unauthorized")
+
+	send(conn, "auth 4dmin\nsessions\nconfig\n")
+	expectLines(t, conn, r, "OK", "OK", "OK")
+}
+
+func TestAuthAdminWithoutAdminSecret(t *testing.T) {
+	a := newAuthState("s3cret", "")
+	if a.allowed("kill") {
+		t.Fatal("expected kill to require authentication")
+	}
+	a.verify("s3cret")
+	if !a.allowed("kill") {
+		t.Fatal("expected authenticated clients to be admins without AdminSecret")
+	}
+}
+
+func TestHTTPAdminAuth(t *testing.T) {
+	p := newTestProgramWithSecret()
+	p.AdminSecret = "4dmin"
+	h := p.newHTTPHandler()
+
+	if code := doHTTP(t, h, http.MethodGet, "/sessions?token=s3cret", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected the secret to be refused, got %d", code)
+	}
+	if code := doHTTP(t, h, http.MethodGet, "/sessions?token=4dmin", nil); code != http.StatusOK {
+		t.Fatalf("expected the admin secret to be accepted, got %d", code)
+	}
+	if code := doHTTP(t, h, http.MethodGet, "/config?token=4dmin", nil); code != http.StatusOK {
+		t.Fatalf("expected the admin secret to grant regular access, got %d", code)
+	}
+}
+
+func TestHTTPStopSessionAuth(t *testing.T) {
+	p := newTestProgramWithSecret()
+	p.AdminSecret = "4dmin"
+	h := p.newHTTPHandler()
+
+	// Held by a connected client
+	sess, err := p.openSession(p.Modems[0], "10.0.0.7:51234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	if code := doHTTP(t, h, http.MethodPost, "/sessions/"+sess.id+"/stop?token=s3cret", nil); code != http.StatusForbidden {
+		t.Fatalf("expected stopping a client session to require the admin secret, got %d", code)
+	}
+	if code := doHTTP(t, h, http.MethodPost, "/sessions/"+sess.id+"/stop?token=4dmin", nil); code != http.StatusOK {
+		t.Fatalf("expected the admin secret to be accepted, got %d", code)
+	}
+
+	// Started over HTTP
+	var started sessionPayload
+	if code := doHTTP(t, h, http.MethodPost, "/modems/IC705HF/start?token=s3cret", &started); code != http.StatusCreated {
+		t.Fatalf("expected the session to start, got %d", code)
+	}
+	if code := doHTTP(t, h, http.MethodPost, "/sessions/"+started.ID+"/stop?token=s3cret", nil); code != http.StatusOK {
+		t.Fatalf("expected the secret to stop a session started over HTTP, got %d", code)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Severity of a problem found in the configuration. Errors prevent varanny from
+// starting, warnings are logged.
+type severity int
+
+const (
+	severityError severity = iota
+	severityWarning
+)
+
+func (s severity) String() string {
+	if s == severityWarning {
+		return "WARNING"
+	}
+	return "ERROR"
+}
+
+// CAT control dialects clients know how to talk
+var knownDialects = map[string]bool{
+	"hamlib": true,
+}
+
+// A problem found in the configuration
+type configProblem struct {
+	Severity severity
+	Modem    string // empty for global settings
+	Message  string
+}
+
+func (c configProblem) String() string {
+	if c.Modem != "" {
+		return c.Severity.String() + " modem '" + c.Modem + "': " + c.Message
+	}
+	return c.Severity.String() + " " + c.Message
+}
+
+type configProblems []configProblem
+
+func (c configProblems) errors() configProblems {
+	var errs configProblems
+	for _, problem := range c {
+		if problem.Severity == severityError {
+			errs = append(errs, problem)
+		}
+	}
+	return errs
+}
+
+func (c configProblems) Error() string {
+	var messages []string
+	for _, problem := range c {
+		messages = append(messages, problem.String())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Check the whole configuration and report every problem found rather than stopping
+// at the first one. The port of every modem is looked up along the way.
+func checkConfig(conf *Config) configProblems {
+	var problems configProblems
+	addError := func(modem string, format string, args ...interface{}) {
+		problems = append(problems, configProblem{severityError, modem, fmt.Sprintf(format, args...)})
+	}
+	addWarning := func(modem string, format string, args ...interface{}) {
+		problems = append(problems, configProblem{severityWarning, modem, fmt.Sprintf(format, args...)})
+	}
+
+	// Settings are prefixed with "CatCtrl " for the CAT control process
+	checkProcessEnv := func(modem string, prefix string, e ProcessEnv) {
+		names := make([]string, 0, len(e.Env))
+		for name := range e.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if name == "" || strings.ContainsAny(name, "=\x00") {
+				addError(modem, "invalid %sEnv variable name '%s'", prefix, name)
+			}
+		}
+		if e.WorkDir != "" {
+			dir := os.ExpandEnv(e.WorkDir)
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				addError(modem, "%sWorkDir %s is not a directory", prefix, dir)
+			}
+		}
+		if e.WinePrefix != "" {
+			if dir := os.ExpandEnv(e.WinePrefix); !FileExists(dir) {
+				addWarning(modem, "%sWinePrefix %s does not exist, Wine will create it", prefix, dir)
+			}
+		}
+	}
+
+	if len(conf.Modems) == 0 {
+		addError("", "No modems defined")
+	}
+
+	var err error
+	conf.access, err = newAccessList(conf.AllowedNetworks, conf.DeniedNetworks)
+	if err != nil {
+		addError("", "%v", err)
+	}
+
+	if (conf.TLS.CertFile == "") != (conf.TLS.KeyFile == "") {
+		addError("", "TLS requires both CertFile and KeyFile")
+	}
+
+	if conf.Display != nil {
+		if err := assertExecutable(conf.Display.command()); err != nil {
+			addError("", "Display: %v", err)
+		}
+		if _, err := conf.Display.Args.split(); err != nil {
+			addError("", "invalid Display Args: %v", err)
+		}
+	}
+
+	if conf.IdleTimeout < 0 {
+		addError("", "IdleTimeout must not be negative")
+	}
+	if conf.KeepAlive != nil && *conf.KeepAlive < 0 {
+		addError("", "KeepAlive must not be negative")
+	}
+
+	names := map[string]string{}
+	catPorts := map[int]*Modem{}
+	for _, modem := range conf.Modems {
+		name := modem.Name
+		// Clients look up names regardless of case
+		if name == "" {
+			addError("", "modem without a Name")
+		} else if other, ok := names[strings.ToLower(name)]; ok && other == name {
+			addError(name, "duplicate modem name, names must be unique")
+		} else if ok {
+			addError(name, "modem name only differs in case from '%s', names must be unique regardless of case", other)
+		} else {
+			names[strings.ToLower(name)] = name
+		}
+
+		modem.access, err = newAccessList(modem.AllowedNetworks, modem.DeniedNetworks)
+		if err != nil {
+			addError(name, "%v", err)
+		}
+
+		if modem.StartTimeout < 0 {
+			addError(name, "StartTimeout must not be negative")
+		}
+		if modem.StopTimeout < 0 {
+			addError(name, "StopTimeout must not be negative")
+		}
+		if modem.HookTimeout < 0 {
+			addError(name, "HookTimeout must not be negative")
+		}
+		for _, hooks := range []struct {
+			stage string
+			hooks []CommandArgs
+		}{
+			{hookPreStart, modem.PreStart},
+			{hookPostStart, modem.PostStart},
+			{hookPreStop, modem.PreStop},
+			{hookPostStop, modem.PostStop},
+		} {
+			for _, hook := range hooks.hooks {
+				args, err := hook.split()
+				if err == nil && len(args) == 0 {
+					err = fmt.Errorf("empty command")
+				} else if err == nil {
+					err = assertExecutable(args[0])
+				}
+				if err != nil {
+					addError(name, "%s hook '%s': %v", hooks.stage, hook, err)
+				}
+			}
+		}
+		if modem.KillWineserver {
+			if err := assertExecutable("wineserver"); err != nil {
+				addWarning(name, "KillWineserver is set but wineserver cannot be run: %v", err)
+			}
+		}
+
+		if modem.Cmd == "" {
+			addError(name, "modem executable not defined")
+		} else if err := assertExecutable(modem.Cmd); err != nil {
+			addError(name, "%v", err)
+		}
+
+		switch modem.Type {
+		case "fm", "hf":
+		default:
+			addError(name, "unknown modem type '%s', expected fm or hf", modem.Type)
+		}
+
+		if modem.Config != "" {
+			if err := assertConfigFile(modem.Config); err != nil {
+				addError(name, "%v", err)
+			}
+		}
+
+		var varaDefaultConfigFile = modem.DefaultConfig
+		if varaDefaultConfigFile != "" {
+			if err := assertConfigFile(varaDefaultConfigFile); err != nil {
+				addError(name, "%v", err)
+			}
+		}
+
+		// Figure out .ini file name for this modem and lookup port
+		iniFilePath, err := specifiedIniConfigPath(modem, varaDefaultConfigFile)
+		if err != nil {
+			addError(name, "%v", err)
+		} else if modem.Port, err = GetPort(iniFilePath); err != nil || modem.Port == 0 {
+			addError(name, "port number not found in %s", iniFilePath)
+		}
+
+		checkProcessEnv(name, "", modem.ProcessEnv)
+		if _, err := modem.Args.split(); err != nil {
+			addError(name, "invalid Args: %v", err)
+		}
+		if looksLikeUnescapedPath(modem.Cmd) || looksLikeUnescapedPath(string(modem.Args)) {
+			addWarning(name, "Cmd or Args contain control characters, backslashes in Windows paths must be escaped as \\\\")
+		}
+
+		cat := modem.CatCtrl
+		if cat.Cmd != "" {
+			if err := assertExecutable(cat.Cmd); err != nil {
+				addError(name, "%v", err)
+			}
+		}
+		checkProcessEnv(name, "CatCtrl ", cat.ProcessEnv)
+		if _, err := cat.Args.split(); err != nil {
+			addError(name, "invalid CatCtrl Args: %v", err)
+		}
+		if looksLikeUnescapedPath(cat.Cmd) || looksLikeUnescapedPath(string(cat.Args)) {
+			addWarning(name, "CatCtrl Cmd or Args contain control characters, backslashes in Windows paths must be escaped as \\\\")
+		}
+		if cat.Port != 0 {
+			if !knownDialects[cat.Dialect] {
+				addWarning(name, "unknown CatCtrl Dialect '%s', clients may not be able to use it", cat.Dialect)
+			}
+			// Modems sharing a radio share its CAT daemon, different daemons
+			// cannot listen on the same port
+			if other := catPorts[cat.Port]; other != nil && (other.CatCtrl.Cmd != cat.Cmd || other.CatCtrl.Args != cat.Args) {
+				addWarning(name, "CAT port %d is also used by '%s' with a different command", cat.Port, other.Name)
+			} else if other == nil {
+				catPorts[cat.Port] = modem
+			}
+		}
+	}
+	return problems
+}
+
+// Print the problems found in the configuration file for -check-config. Returns the
+// process exit code, non zero when the configuration has errors.
+func runConfigCheck(path string, w io.Writer) int {
+	conf, err := getConfig(path)
+	if err != nil {
+		fmt.Fprintln(w, "ERROR "+err.Error()+configSyntaxHint(err))
+		return 1
+	}
+
+	problems := checkConfig(conf)
+	for _, problem := range problems {
+		fmt.Fprintln(w, problem)
+	}
+	if errs := problems.errors(); len(errs) > 0 {
+		fmt.Fprintf(w, "%s: %d error(s), %d warning(s)\n", path, len(errs), len(problems)-len(errs))
+		return 1
+	}
+	fmt.Fprintf(w, "%s: OK, %d warning(s)\n", path, len(problems))
+	return 0
+}
+
+// A Windows path written with single backslashes in JSON either fails to parse or,
+// for sequences such as \t or \n, silently turns into control characters
+func looksLikeUnescapedPath(s string) bool {
+	return strings.ContainsAny(s, "\t\n\r\b\f")
+}
+
+// Hint at the usual cause of a JSON syntax error in the configuration file
+func configSyntaxHint(err error) string {
+	if strings.Contains(err.Error(), "escape") {
+		return " (backslashes in Windows paths must be escaped as \\\\)"
+	}
+	return ""
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func expectProblems(t *testing.T, problems configProblems, want ...string) {
+	t.Helper()
+	var got []string
+	for _, problem := range problems {
+		got = append(got, problem.String())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("expected problems\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestCheckConfigReportsEveryProblem(t *testing.T) {
+	dir := t.TempDir()
+	ini := filepath.Join(dir, "VARA.ini")
+	writeTestFile(t, ini, "[Setup]\nTCP Command Port=8300\n")
+
+	conf := &Config{
+		Modems: []*Modem{
+			{Name: "FM", Type: "fm", Cmd: "echo", DefaultConfig: ini, CatCtrl: CatCtrl{Port: 4532, Dialect: "hamlib", Cmd: "echo", Args: "-m 3085"}},
+			{Name: "FM", Type: "vhf", Cmd: "echo", DefaultConfig: ini},
+			{Name: "fm", Type: "fm", Cmd: "echo", DefaultConfig: ini},
+			{Name: "HF", Type: "hf", Cmd: "does-not-exist-varanny", Args: "C:\tools\\VARA.exe", DefaultConfig: ini, CatCtrl: CatCtrl{Port: 4532, Dialect: "flrig", Cmd: "echo", Args: "-m 1"}},
+		},
+	}
+	problems := checkConfig(conf)
+	expectProblems(t, problems,
+		"ERROR modem 'FM': duplicate modem name, names must be unique",
+		"ERROR modem 'FM': unknown modem type 'vhf', expected fm or hf",
+		"ERROR modem 'fm': modem name only differs in case from 'FM', names must be unique regardless of case",
+		"ERROR modem 'HF': "+assertExecutable("does-not-exist-varanny").Error(),
+		`WARNING modem 'HF': Cmd or Args contain control characters, backslashes in Windows paths must be escaped as \\`,
+		"WARNING modem 'HF': unknown CatCtrl Dialect 'flrig', clients may not be able to use it",
+		"WARNING modem 'HF': CAT port 4532 is also used by 'FM' with a different command",
+	)
+	if len(problems.errors()) != 4 {
+		t.Fatalf("expected 4 errors, got %d", len(problems.errors()))
+	}
+	if conf.Modems[0].Port != 8300 {
+		t.Fatalf("expected port to be looked up, got %d", conf.Modems[0].Port)
+	}
+}
+
+func TestCheckConfigSharedCatDaemon(t *testing.T) {
+	dir := t.TempDir()
+	ini := filepath.Join(dir, "VARA.ini")
+	writeTestFile(t, ini, "[Setup]\nTCP Command Port=8300\n")
+
+	cat := CatCtrl{Port: 4532, Dialect: "hamlib", Cmd: "echo", Args: "-m 3085"}
+	conf := &Config{
+		Modems: []*Modem{
+			{Name: "IC705FM", Type: "fm", Cmd: "echo", DefaultConfig: ini, CatCtrl: cat},
+			{Name: "IC705HF", Type: "hf", Cmd: "echo", DefaultConfig: ini, CatCtrl: cat},
+		},
+	}
+	expectProblems(t, checkConfig(conf))
+}
+
+func TestRunConfigCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "varanny.json")
+	writeTestConfig(t, path, "A:a")
+
+	var out bytes.Buffer
+	if code := runConfigCheck(path, &out); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, out.String())
+	}
+
+	writeTestFile(t, path, `{"Modems": []}`)
+	out.Reset()
+	if code := runConfigCheck(path, &out); code == 0 || !strings.Contains(out.String(), "ERROR No modems defined") {
+		t.Fatalf("expected failure, got %d: %s", code, out.String())
+	}
+
+	writeTestFile(t, path, `{"Modems": [{"Cmd": "C:\VARA\VARA.exe"}]}`)
+	out.Reset()
+	if code := runConfigCheck(path, &out); code == 0 || !strings.Contains(out.String(), "must be escaped") {
+		t.Fatalf("expected escaping hint, got %d: %s", code, out.String())
+	}
+}
+
+func TestCheckConfigTimeouts(t *testing.T) {
+	keepAlive := -1
+	conf := &Config{IdleTimeout: -5, KeepAlive: &keepAlive, Modems: []*Modem{{Name: "FM", Type: "fm", Cmd: "echo", Port: 8300}}}
+	problems := checkConfig(conf)
+	if len(problems) < 2 || problems[0].String() != "ERROR IdleTimeout must not be negative" || problems[1].String() != "ERROR KeepAlive must not be negative" {
+		t.Fatalf("unexpected problems %v", problems)
+	}
+}
+
+func TestCheckConfigInvalidArgs(t *testing.T) {
+	conf := &Config{Modems: []*Modem{{Name: "FM", Type: "fm", Cmd: "echo", Port: 8300, Args: `"unterminated`, CatCtrl: CatCtrl{Args: "-r 'COM7"}}}}
+	problems := checkConfig(conf)
+	var got []string
+	for _, problem := range problems {
+		if strings.Contains(problem.Message, "Args") {
+			got = append(got, problem.String())
+		}
+	}
+	want := []string{`ERROR modem 'FM': invalid Args: unterminated " quote`, `ERROR modem 'FM': invalid CatCtrl Args: unterminated ' quote`}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected problems %q", got)
+	}
+}
+
+func TestCheckConfigProcessEnv(t *testing.T) {
+	dir := t.TempDir()
+	conf := &Config{Modems: []*Modem{{
+		Name: "HF", Type: "hf", Cmd: "echo", Port: 8400,
+		ProcessEnv: ProcessEnv{Env: map[string]string{"A=B": "c"}, WorkDir: filepath.Join(dir, "missing")},
+		CatCtrl:    CatCtrl{ProcessEnv: ProcessEnv{WinePrefix: filepath.Join(dir, "wine")}},
+	}}}
+	var got []string
+	for _, problem := range checkConfig(conf) {
+		if !strings.Contains(problem.Message, "ini file") {
+			got = append(got, problem.String())
+		}
+	}
+	want := []string{
+		"ERROR modem 'HF': invalid Env variable name 'A=B'",
+		"ERROR modem 'HF': WorkDir " + filepath.Join(dir, "missing") + " is not a directory",
+		"WARNING modem 'HF': CatCtrl WinePrefix " + filepath.Join(dir, "wine") + " does not exist, Wine will create it",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected problems\n%s", strings.Join(got, "\n"))
+	}
+}
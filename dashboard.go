@@ -0,0 +1,26 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// Single page status UI, served at the root of the HTTP API
+//
+//go:embed web/index.html
+var dashboardHTML []byte
+
+// GET /
+func (p *program) handleDashboard(w http.ResponseWriter, req *http.Request) {
+	// The mux routes every unknown path here
+	if req.URL.Path != "/" {
+		writeHTTPError(w, http.StatusNotFound, errCodeNotFound, "unknown endpoint "+req.URL.Path)
+		return
+	}
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(dashboardHTML)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	h := newTestProgram().newHTTPHandler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "<title>varanny</title>") {
+		t.Fatal("expected the embedded dashboard")
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/nothing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown path to be not found, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Directory where X servers create the socket of each display
+var x11SocketDir = "/tmp/.X11-unix"
+
+// Time the display server has to accept connections once started
+var displayStartTimeout = 5 * time.Second
+
+// Virtual X display for VARA running under Wine on a headless host
+type Display struct {
+	Number int         `json:"Number"` // display number, defaults to 99 for DISPLAY=:99
+	Cmd    string      `json:"Cmd"`    // defaults to Xvfb
+	Args   CommandArgs `json:"Args"`   // defaults to ":<Number> -screen 0 1024x768x16 -nolisten tcp"
+}
+
+func (d Display) name() string {
+	number := d.Number
+	if number == 0 {
+		number = 99
+	}
+	return ":" + strconv.Itoa(number)
+}
+
+func (d Display) command() string {
+	if d.Cmd == "" {
+		return "Xvfb"
+	}
+	return d.Cmd
+}
+
+func (d Display) args() ([]string, error) {
+	if d.Args == "" {
+		return []string{d.name(), "-screen", "0", "1024x768x16", "-nolisten", "tcp"}, nil
+	}
+	return d.Args.split()
+}
+
+// Starts the display server when the first session needs it and stops it once the
+// last one ended. A server that died is started again by the next session.
+type displayServer struct {
+	conf  Display
+	mu    sync.Mutex
+	users int
+	cmd   *exec.Cmd
+	done  chan struct{} // closed once the server process has been reaped
+	stop  chan struct{} // closed before the server is terminated on purpose
+}
+
+// Returns nil when no display is configured
+func newDisplayServer(conf *Display) *displayServer {
+	if conf == nil {
+		return nil
+	}
+	return &displayServer{conf: *conf}
+}
+
+// Start the display server if needed and return the DISPLAY value to use.
+// Every successful call must be matched by a release.
+func (d *displayServer) acquire() (string, error) {
+	if d == nil {
+		return "", nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if processStatus(d.cmd, d.done) != "running" {
+		err := d.start()
+		if err != nil {
+			return "", err
+		}
+	}
+	d.users++
+	return d.conf.name(), nil
+}
+
+// Stop the display server when no session needs it anymore
+func (d *displayServer) release() {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.users--
+	if d.users > 0 || d.cmd == nil {
+		return
+	}
+	log.Println("No session needs display", d.conf.name(), "anymore")
+	d.terminate()
+}
+
+// Must be called with d.mu held
+func (d *displayServer) terminate() {
+	close(d.stop)
+	terminateProcess(d.cmd, d.done, "display", defaultStopTimeout)
+	d.cmd, d.done, d.stop = nil, nil, nil
+}
+
+// Start the server and wait for its socket, must be called with d.mu held
+func (d *displayServer) start() error {
+	name := d.conf.name()
+	args, err := d.conf.args()
+	if err != nil {
+		return fmt.Errorf("invalid Display Args: %v", err)
+	}
+	cmd := createCommand(log.Writer(), d.conf.command(), args...)
+	if cmd == nil {
+		return fmt.Errorf("cannot find display server %s", d.conf.command())
+	}
+
+	log.Println("Starting display", name)
+	log.Println("Command:", cmd.Path, cmd.Args)
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	stop := make(chan struct{})
+	go func() {
+		defer close(done)
+		state, err := cmd.Process.Wait()
+		select {
+		case <-stop:
+		default:
+			if err == nil {
+				log.Println("ERROR display", name, "exited unexpectedly with code", state.ExitCode())
+			}
+		}
+	}()
+	d.cmd, d.done, d.stop = cmd, done, stop
+
+	socket := filepath.Join(x11SocketDir, "X"+name[1:])
+	deadline := time.Now().Add(displayStartTimeout)
+	for !FileExists(socket) {
+		select {
+		case <-done:
+			d.cmd, d.done, d.stop = nil, nil, nil
+			return fmt.Errorf("display %s exited on startup", name)
+		default:
+		}
+		if time.Now().After(deadline) {
+			d.terminate()
+			return fmt.Errorf("display %s not ready within %v", name, displayStartTimeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Replace Xvfb with a shell creating the display socket and counting its starts
+func fakeDisplay(t *testing.T) (*Display, string) {
+	dir := t.TempDir()
+	saved := x11SocketDir
+	x11SocketDir = dir
+	t.Cleanup(func() { x11SocketDir = saved })
+
+	starts := filepath.Join(dir, "starts")
+	script := `echo started >> "` + starts + `"; touch "` + filepath.Join(dir, "X42") + `"; exec sleep 10`
+	return &Display{Number: 42, Cmd: "sh", Args: CommandArgs(quoteArgs([]string{"-c", script}))}, starts
+}
+
+func displayStarts(t *testing.T, path string) int {
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return strings.Count(string(content), "started")
+}
+
+func TestDisplayServerSharedBySessions(t *testing.T) {
+	conf, starts := fakeDisplay(t)
+	d := newDisplayServer(conf)
+
+	for i := 0; i < 2; i++ {
+		name, err := d.acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != ":42" {
+			t.Fatalf("unexpected display %q", name)
+		}
+	}
+	if n := displayStarts(t, starts); n != 1 {
+		t.Fatalf("expected a single display server, got %d", n)
+	}
+
+	d.release()
+	if processStatus(d.cmd, d.done) != "running" {
+		t.Fatal("display stopped while still in use")
+	}
+	done := d.done
+	d.release()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("display not stopped after the last session")
+	}
+
+	// Started again on demand
+	os.Remove(filepath.Join(x11SocketDir, "X42"))
+	if _, err := d.acquire(); err != nil {
+		t.Fatal(err)
+	}
+	d.release()
+	if n := displayStarts(t, starts); n != 2 {
+		t.Fatalf("expected the display to be started again, got %d starts", n)
+	}
+}
+
+func TestDisplayServerFailures(t *testing.T) {
+	fakeDisplay(t)
+	saved := displayStartTimeout
+	displayStartTimeout = 200 * time.Millisecond
+	defer func() { displayStartTimeout = saved }()
+
+	d := newDisplayServer(&Display{Cmd: "false"})
+	if _, err := d.acquire(); err == nil || err.Error() != "display :99 exited on startup" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	d = newDisplayServer(&Display{Cmd: "sleep", Args: "10"})
+	if _, err := d.acquire(); err == nil || err.Error() != "display :99 not ready within 200ms" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if d.cmd != nil || d.users != 0 {
+		t.Fatal("expected the display server to be stopped")
+	}
+
+	var none *displayServer
+	if name, err := none.acquire(); name != "" || err != nil {
+		t.Fatalf("expected no display, got %q %v", name, err)
+	}
+}
+
+func TestSessionExportsDisplay(t *testing.T) {
+	conf, _ := fakeDisplay(t)
+	dir := t.TempDir()
+	p := newTestProgram()
+	p.display = newDisplayServer(conf)
+	modem := p.Modems[0]
+	modem.Cmd = "sh"
+	modem.Args = CommandArgs(quoteArgs([]string{"-c", `echo "$DISPLAY" > "` + filepath.Join(dir, "display.txt") + `"; exec sleep 10`}))
+
+	sess, err := p.openSession(modem, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sess.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		content, _ := os.ReadFile(filepath.Join(dir, "display.txt"))
+		if string(content) == ":42\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("DISPLAY not exported to the modem, got %q", content)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := p.display.done
+	sess.close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("display not stopped with the session")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Stages at which the hooks of a modem run
+const (
+	hookPreStart  = "PreStart"  // before CAT control and VARA start, a failure aborts the start
+	hookPostStart = "PostStart" // once VARA is listening
+	hookPreStop   = "PreStop"   // before VARA and CAT control are stopped
+	hookPostStop  = "PostStop"  // once everything is stopped and the .ini file restored
+)
+
+// Default for Modem.HookTimeout
+const defaultHookTimeout = 10 * time.Second
+
+func (m *Modem) hookTimeout() time.Duration {
+	if m.HookTimeout > 0 {
+		return time.Duration(m.HookTimeout) * time.Second
+	}
+	return defaultHookTimeout
+}
+
+// Returned when a hook could not run, exited with an error or timed out
+type hookError struct {
+	stage string
+	hook  CommandArgs
+	err   error
+}
+
+func (e *hookError) Error() string {
+	return "hook " + e.stage + " '" + string(e.hook) + "' failed: " + e.err.Error()
+}
+
+// Run the hooks of a stage in order. A failing PreStart hook stops there and its
+// error is returned, failures at the other stages are logged and the next hook runs.
+// Once a PreStart hook succeeded the stop hooks run, so they can undo it even if a
+// later one failed.
+func (s *session) runHooks(stage string, hooks []CommandArgs) error {
+	for _, hook := range hooks {
+		err := s.runHook(stage, hook)
+		if err == nil {
+			if stage == hookPreStart {
+				s.setHooked()
+			}
+			continue
+		}
+		if stage == hookPreStart {
+			return err
+		}
+		log.Println("ERROR", err)
+	}
+	return nil
+}
+
+// Run a hook and wait for it to exit. It gets the environment of the modem along
+// with VARANNY_* variables describing the session, and is killed with its children
+// after the hook timeout of the modem. Start hooks are also killed when the session
+// is closed meanwhile.
+func (s *session) runHook(stage string, hook CommandArgs) error {
+	var stopping chan struct{}
+	if stage == hookPreStart || stage == hookPostStart {
+		if s.aborted() {
+			return &hookError{stage, hook, errSessionClosed}
+		}
+		stopping = s.stopping
+	}
+
+	args, err := hook.split()
+	if err == nil && len(args) == 0 {
+		err = errors.New("empty command")
+	}
+	if err != nil {
+		return &hookError{stage, hook, err}
+	}
+	cmd := createCommand(log.Writer(), args[0], args[1:]...)
+	if cmd == nil {
+		return &hookError{stage, hook, fmt.Errorf("cannot find %s", args[0])}
+	}
+	s.modem.ProcessEnv.apply(cmd)
+	cmd.Env = append(cmd.Env, s.hookEnv(stage)...)
+
+	log.Println("Running", stage, "hook for", s.modem.Name+":", string(hook))
+	err = cmd.Start()
+	if err != nil {
+		return &hookError{stage, hook, err}
+	}
+
+	// Use Process.Wait rather than cmd.Wait, a hook may leave a daemon behind
+	// holding on to the output pipes
+	done := make(chan struct{})
+	var state error
+	go func() {
+		defer close(done)
+		processState, err := cmd.Process.Wait()
+		if err != nil {
+			state = err
+		} else if !processState.Success() {
+			state = fmt.Errorf("exit status %d", processState.ExitCode())
+		}
+	}()
+
+	timeout := s.modem.hookTimeout()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		signalProcessGroup(cmd, syscall.SIGKILL)
+		<-done
+		return &hookError{stage, hook, fmt.Errorf("timed out after %v", timeout)}
+	case <-stopping:
+		signalProcessGroup(cmd, syscall.SIGKILL)
+		<-done
+		return &hookError{stage, hook, errSessionClosed}
+	}
+	if state != nil {
+		return &hookError{stage, hook, state}
+	}
+	return nil
+}
+
+func (s *session) setHooked() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooked = true
+}
+
+// Variables describing the session to hooks
+func (s *session) hookEnv(stage string) []string {
+	modem := s.modem
+	client, _, err := net.SplitHostPort(s.client)
+	if err != nil {
+		client = s.client
+	}
+	env := []string{
+		"VARANNY_HOOK=" + stage,
+		"VARANNY_SESSION=" + s.id,
+		"VARANNY_MODEM=" + modem.Name,
+		"VARANNY_MODEM_TYPE=" + modem.Type,
+		"VARANNY_CLIENT=" + client,
+	}
+	if modem.Port != 0 {
+		env = append(env,
+			"VARANNY_PORT="+strconv.Itoa(modem.Port),
+			"VARANNY_DATA_PORT="+strconv.Itoa(modem.Port+1))
+	}
+	if modem.CatCtrl.Port != 0 {
+		env = append(env, "VARANNY_CAT_PORT="+strconv.Itoa(modem.CatCtrl.Port))
+	}
+	s.mu.Lock()
+	startFailed := s.startFailed
+	s.mu.Unlock()
+	if startFailed && (stage == hookPreStop || stage == hookPostStop) {
+		env = append(env, "VARANNY_START_FAILED=1")
+	}
+	return env
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// Hook appending its stage and part of its environment to the returned log file
+func newLoggingHook(t *testing.T) (CommandArgs, string) {
+	out := filepath.Join(t.TempDir(), "hooks.log")
+	hook := CommandArgs(quoteArgs([]string{"sh", "-c", `echo "$VARANNY_HOOK $VARANNY_SESSION $VARANNY_MODEM $VARANNY_CLIENT $VARANNY_CAT_PORT ${VARANNY_START_FAILED:-0}" >> "` + out + `"`}))
+	return hook, out
+}
+
+func TestHooksRunAroundSession(t *testing.T) {
+	hook, out := newLoggingHook(t)
+	p := newTestProgram()
+	modem := p.Modems[0]
+	modem.Cmd = "sleep"
+	modem.Args = "10"
+	modem.CatCtrl.Port = 4532
+	modem.PreStart = []CommandArgs{hook}
+	modem.PostStart = []CommandArgs{hook}
+	modem.PreStop = []CommandArgs{hook}
+	modem.PostStop = []CommandArgs{hook}
+
+	conn, r, done := startTestSession(t, p)
+	send(conn, "start IC705FM\n")
+	expectLines(t, conn, r, "OK")
+	expectFileContent(t, out, "PreStart 1 IC705FM pipe 4532 0\nPostStart 1 IC705FM pipe 4532 0\n")
+
+	send(conn, "stop\n")
+	expectLines(t, conn, r, "OK")
+	<-done
+	expectFileContent(t, out, "PreStart 1 IC705FM pipe 4532 0\nPostStart 1 IC705FM pipe 4532 0\nPreStop 1 IC705FM pipe 4532 0\nPostStop 1 IC705FM pipe 4532 0\n")
+}
+
+func TestFailingPreStartHookAbortsStart(t *testing.T) {
+	hook, out := newLoggingHook(t)
+	p := newTestProgram()
+	modem := p.Modems[0]
+	modem.Cmd = "sleep"
+	modem.Args = "10"
+	modem.CatCtrl.Port = 4532
+	modem.PreStart = []CommandArgs{hook, "false", "touch never"}
+	modem.PostStart = []CommandArgs{hook}
+	modem.PreStop = []CommandArgs{hook}
+	modem.PostStop = []CommandArgs{hook}
+
+	conn, r, done := startTestSession(t, p)
+	send(conn, "start IC705FM\n")
+	expectLines(t, conn, r, "ERROR hook PreStart 'false' failed: exit status 1")
+	<-done
+
+	// The stop hooks undo what the first PreStart hook did, knowing the start failed
+	expectFileContent(t, out, "PreStart 1 IC705FM pipe 4532 0\nPreStop 1 IC705FM pipe 4532 1\nPostStop 1 IC705FM pipe 4532 1\n")
+	if p.sessions.forModem(modem) != nil {
+		t.Fatal("expected the session to be closed")
+	}
+}
+
+func TestFirstPreStartHookFailingRunsNoStopHooks(t *testing.T) {
+	hook, out := newLoggingHook(t)
+	p := newTestProgram()
+	modem := p.Modems[0]
+	modem.PreStart = []CommandArgs{"false"}
+	modem.PreStop = []CommandArgs{hook}
+	modem.PostStop = []CommandArgs{hook}
+
+	conn, r, done := startTestSession(t, p)
+	send(conn, "start IC705FM\n")
+	expectLines(t, conn, r, "ERROR hook PreStart 'false' failed: exit status 1")
+	<-done
+
+	// Nothing was set up, there is nothing to undo
+	if FileExists(out) {
+		t.Fatal("expected no stop hooks to run")
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	p := newTestProgram()
+	modem := p.Modems[0]
+	modem.HookTimeout = 1
+	modem.PreStart = []CommandArgs{"sleep 10"}
+
+	conn, r, _ := startTestSession(t, p)
+	send(conn, "start IC705FM\n")
+	expectLines(t, conn, r, "ERROR hook PreStart 'sleep 10' failed: timed out after 1s")
+}
+
+func TestMonitorRunsNoHooks(t *testing.T) {
+	fakeAudioInput(t, -20)
+	hook, out := newLoggingHook(t)
+	p := newTestProgram()
+	modem := p.Modems[0]
+	modem.PreStart = []CommandArgs{hook}
+	modem.PostStart = []CommandArgs{hook}
+	modem.PreStop = []CommandArgs{hook}
+	modem.PostStop = []CommandArgs{hook}
+
+	conn, r, done := startTestSession(t, p)
+	send(conn, "monitor IC705FM\n")
+	expectLines(t, conn, r, "OK", "Fake USB Audio")
+	conn.Close()
+	<-done
+	if FileExists(out) {
+		t.Fatal("expected no hooks to run for monitoring")
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error code reported when an endpoint is called with the wrong HTTP method
+const errCodeMethodNotAllowed = "method_not_allowed"
+
+// State of a modem as reported by the HTTP API
+type modemState struct {
+	Name    string          `json:"name"`
+	Type    string          `json:"type"`
+	Port    int             `json:"port"`
+	CatPort int             `json:"cat_port,omitempty"`
+	Running bool            `json:"running"`
+	Session *sessionPayload `json:"session,omitempty"`
+}
+
+type sessionPayload struct {
+	ID      string    `json:"id"`
+	Modem   string    `json:"modem"`
+	Client  string    `json:"client"`
+	Monitor bool      `json:"monitor"`
+	Started time.Time `json:"started"`
+	Uptime  int64     `json:"uptime"` // seconds, the station clock may be off
+	// Last command received from the client holding the session
+	LastActivity time.Time `json:"last_activity"`
+	// State of the VARA and CAT control processes: "running", "exited" or "none"
+	ModemProcess string `json:"modem_process"`
+	CatProcess   string `json:"cat_process"`
+}
+
+func newSessionPayload(s *session) *sessionPayload {
+	modemProcess, catProcess := s.processStatus()
+	return &sessionPayload{
+		ID:           s.id,
+		Modem:        s.modem.Name,
+		Client:       s.client,
+		Monitor:      s.isMonitor(),
+		Started:      s.started,
+		Uptime:       int64(time.Since(s.started).Seconds()),
+		LastActivity: s.lastActivity(),
+		ModemProcess: modemProcess,
+		CatProcess:   catProcess,
+	}
+}
+
+func (p *program) modemState(modem *Modem) modemState {
+	state := modemState{
+		Name:    modem.Name,
+		Type:    modem.Type,
+		Port:    modem.Port,
+		CatPort: modem.CatCtrl.Port,
+	}
+	if s := p.sessions.forModem(modem); s != nil {
+		state.Running = true
+		state.Session = newSessionPayload(s)
+	}
+	return state
+}
+
+// Routes of the management API. Paths are matched by hand as modem names may
+// contain spaces and the standard mux of our go version has no path parameters.
+func (p *program) newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", p.handleDashboard)
+	mux.HandleFunc("/version", p.handleHTTPVersion)
+	mux.HandleFunc("/config", p.requireAuth(p.handleHTTPConfig))
+	mux.HandleFunc("/modems", p.handleHTTPModems)
+	mux.HandleFunc("/modems/", p.requireAuth(p.handleHTTPModem))
+	mux.HandleFunc("/sessions", p.requireAdmin(p.handleHTTPSessions))
+	mux.HandleFunc("/sessions/", p.requireAuth(p.handleHTTPSession))
+	mux.HandleFunc("/reload", p.requireAdmin(p.handleHTTPReload))
+	return p.restrictNetworks(mux)
+}
+
+// Reject requests without the shared secret when one is configured
+func (p *program) requireAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !p.authorizedHTTP(req) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeHTTPError(w, http.StatusUnauthorized, errCodeUnauthorized, "unauthorized")
+			return
+		}
+		h(w, req)
+	}
+}
+
+// Reject requests without the admin secret, see authorizedHTTPAdmin
+func (p *program) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !p.authorizedHTTPAdmin(req) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeHTTPError(w, http.StatusUnauthorized, errCodeUnauthorized, "unauthorized")
+			return
+		}
+		h(w, req)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, code string, message string) {
+	log.Println("ERROR " + message)
+	writeJSON(w, status, response{Status: "error", ErrorCode: code, Error: message})
+}
+
+func allowMethod(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method != method {
+		w.Header().Set("Allow", method)
+		writeHTTPError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method "+req.Method+" not allowed")
+		return false
+	}
+	return true
+}
+
+// GET /version
+func (p *program) handleHTTPVersion(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, response{Status: "ok", Type: "version", Version: version})
+}
+
+// GET /config
+func (p *program) handleHTTPConfig(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, newConfigPayload(p.configFilePath(), p.config().Modems))
+}
+
+// GET /modems, public. The sessions and their clients are only shown to
+// authenticated requests.
+func (p *program) handleHTTPModems(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	authorized := p.authorizedHTTP(req)
+	states := []modemState{}
+	for _, modem := range p.config().Modems {
+		state := p.modemState(modem)
+		if !authorized {
+			state.Session = nil
+		}
+		states = append(states, state)
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+// GET /modems/{name}, POST /modems/{name}/start and GET /modems/{name}/levels
+func (p *program) handleHTTPModem(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/modems/")
+	action := ""
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name, action = name[:i], name[i+1:]
+	}
+
+	modem, err := p.lookupModem(name)
+	if err != nil {
+		status := http.StatusNotFound
+		if errorCode(err, errCodeNotFound) == errCodeAmbiguous {
+			status = http.StatusBadRequest
+		}
+		writeHTTPError(w, status, errorCode(err, errCodeNotFound), err.Error())
+		return
+	}
+
+	switch action {
+	case "":
+		if !allowMethod(w, req, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, p.modemState(modem))
+	case "start":
+		if !allowMethod(w, req, http.MethodPost) {
+			return
+		}
+		p.handleHTTPStart(w, req, modem)
+	case "levels":
+		if !allowMethod(w, req, http.MethodGet) {
+			return
+		}
+		p.handleHTTPLevels(w, req, modem)
+	default:
+		writeHTTPError(w, http.StatusNotFound, errCodeNotFound, "unknown endpoint "+req.URL.Path)
+	}
+}
+
+func (p *program) handleHTTPStart(w http.ResponseWriter, req *http.Request, modem *Modem) {
+	err := checkModemAccess(modem, req.RemoteAddr)
+	if err != nil {
+		writeHTTPError(w, http.StatusForbidden, errCodeForbidden, err.Error())
+		return
+	}
+	sess, err := p.openSession(modem, req.RemoteAddr)
+	if err != nil {
+		writeHTTPError(w, http.StatusConflict, errCodeBusy, err.Error())
+		return
+	}
+	sess.mu.Lock()
+	sess.detached = true
+	sess.mu.Unlock()
+	err = sess.start()
+	if err != nil {
+		sess.close()
+		writeHTTPError(w, http.StatusInternalServerError, errCodeStartFailed, err.Error())
+		return
+	}
+	go p.superviseDetachedSession(sess)
+	writeJSON(w, http.StatusCreated, newSessionPayload(sess))
+}
+
+// Stream the input levels of a modem as Server-Sent Events. A "monitor" event carries
+// the device name, followed by a "level" event for every measurement. Any number of
+// viewers can watch the same modem, the capture runs once.
+func (p *program) handleHTTPLevels(w http.ResponseWriter, req *http.Request, modem *Modem) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeHTTPError(w, http.StatusInternalServerError, errCodeInvalidCommand, "streaming not supported")
+		return
+	}
+
+	err := checkModemAccess(modem, req.RemoteAddr)
+	if err != nil {
+		writeHTTPError(w, http.StatusForbidden, errCodeForbidden, err.Error())
+		return
+	}
+
+	levels, device, unsubscribe, err := p.subscribeLevels(modem, req.RemoteAddr)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch errorCode(err, errCodeAudioDevice) {
+		case errCodeBusy:
+			status = http.StatusConflict
+		case errCodeNotFound:
+			status = http.StatusNotFound
+		}
+		writeHTTPError(w, status, errorCode(err, errCodeAudioDevice), err.Error())
+		return
+	}
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	writeSSE(w, response{Status: "ok", Type: "monitor", Device: device})
+	flusher.Flush()
+
+	for {
+		select {
+		case level, ok := <-levels:
+			if !ok {
+				return
+			}
+			writeSSE(w, response{Status: "ok", Type: "level", Level: &level.Level})
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// Write a Server-Sent Event named after the response type
+func writeSSE(w io.Writer, resp response) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", resp.Type, data)
+}
+
+// GET /sessions
+func (p *program) handleHTTPSessions(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	sessions := []*sessionPayload{}
+	for _, s := range p.sessions.list() {
+		sessions = append(sessions, newSessionPayload(s))
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// POST /sessions/{id}/stop. Sessions held by a connected client require the admin
+// secret, those started over HTTP only the secret.
+func (p *program) handleHTTPSession(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/sessions/")
+	if !strings.HasSuffix(path, "/stop") {
+		writeHTTPError(w, http.StatusNotFound, errCodeNotFound, "unknown endpoint "+req.URL.Path)
+		return
+	}
+	id := strings.TrimSuffix(path, "/stop")
+
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+	sess := p.sessions.get(id)
+	if sess == nil {
+		writeHTTPError(w, http.StatusNotFound, errCodeNotFound, "session '"+id+"' not found")
+		return
+	}
+	if !sess.isDetached() && !p.authorizedHTTPAdmin(req) {
+		writeHTTPError(w, http.StatusForbidden, errCodeForbidden, "session '"+id+"' belongs to a connected client, stopping it requires the admin secret")
+		return
+	}
+	log.Println("Stopping session", id, "for", sess.modem.Name, "on HTTP request from", req.RemoteAddr)
+	sess.close()
+	writeJSON(w, http.StatusOK, newSessionPayload(sess))
+}
+
+// POST /reload
+func (p *program) handleHTTPReload(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+	err := p.reload()
+	if err != nil {
+		writeHTTPError(w, http.StatusUnprocessableEntity, errCodeInvalidConfig, "reload failed: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, response{Status: "ok"})
+}
+
+// Sessions started over HTTP have no connection to report events to. Log them and
+// honor EndSessionOnExit.
+func (p *program) superviseDetachedSession(sess *session) {
+	for {
+		select {
+		case event := <-sess.events:
+			log.Println("Session", sess.id, "for", sess.modem.Name, "received event", event.Name, event.ExitCode)
+			if p.config().EndSessionOnExit {
+				log.Println("Ending session for", sess.modem.Name, "after", event.Name)
+				sess.close()
+				return
+			}
+		case <-sess.closed:
+			return
+		}
+	}
+}
+
+// Serve the HTTP API until the program context is cancelled
+func (p *program) serveHTTP() {
+	srv := &http.Server{
+		Addr:    ":" + strconv.Itoa(p.config().HttpPort),
+		Handler: p.newHTTPHandler(),
+	}
+
+	go func() {
+		<-p.ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	log.Println("HTTP API listening on", srv.Addr)
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Println("ERROR HTTP API:", err)
+	}
+}
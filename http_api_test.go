@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func doHTTP(t *testing.T, h http.Handler, method string, path string, v interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if v != nil {
+		err := json.Unmarshal(rec.Body.Bytes(), v)
+		if err != nil {
+			t.Fatalf("invalid json %q: %v", rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func TestHTTPVersion(t *testing.T) {
+	h := newTestProgram().newHTTPHandler()
+	var resp response
+	if code := doHTTP(t, h, http.MethodGet, "/version", &resp); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if resp.Version != version {
+		t.Fatalf("unexpected version %+v", resp)
+	}
+	if code := doHTTP(t, h, http.MethodPost, "/version", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected method not allowed, got %d", code)
+	}
+}
+
+func TestHTTPConfig(t *testing.T) {
+	h := newTestProgram().newHTTPHandler()
+	var config configPayload
+	if code := doHTTP(t, h, http.MethodGet, "/config", &config); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if len(config.Modems) != 2 || config.Modems[0].Name != "IC705FM" {
+		t.Fatalf("unexpected config %+v", config)
+	}
+}
+
+func TestHTTPModems(t *testing.T) {
+	h := newTestProgram().newHTTPHandler()
+	var states []modemState
+	if code := doHTTP(t, h, http.MethodGet, "/modems", &states); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if len(states) != 2 || states[1].Name != "IC705HF" || states[1].Running {
+		t.Fatalf("unexpected modems %+v", states)
+	}
+
+	var errResp response
+	if code := doHTTP(t, h, http.MethodGet, "/modems/nothing", &errResp); code != http.StatusNotFound {
+		t.Fatalf("expected not found, got %d", code)
+	}
+	if errResp.ErrorCode != errCodeNotFound {
+		t.Fatalf("unexpected error %+v", errResp)
+	}
+}
+
+func TestHTTPStartAndStopSession(t *testing.T) {
+	p := newTestProgram()
+	p.Modems[0].Cmd = "sleep"
+	p.Modems[0].Args = "10"
+	h := p.newHTTPHandler()
+
+	var sess sessionPayload
+	if code := doHTTP(t, h, http.MethodPost, "/modems/IC705FM/start", &sess); code != http.StatusCreated {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if sess.ID == "" || sess.Modem != "IC705FM" {
+		t.Fatalf("unexpected session %+v", sess)
+	}
+
+	var state modemState
+	doHTTP(t, h, http.MethodGet, "/modems/IC705FM", &state)
+	if !state.Running || state.Session == nil || state.Session.ID != sess.ID {
+		t.Fatalf("expected modem to be running, got %+v", state)
+	}
+
+	var errResp response
+	if code := doHTTP(t, h, http.MethodPost, "/modems/IC705FM/start", &errResp); code != http.StatusConflict {
+		t.Fatalf("expected conflict, got %d", code)
+	}
+	if errResp.ErrorCode != errCodeBusy {
+		t.Fatalf("unexpected error %+v", errResp)
+	}
+
+	if code := doHTTP(t, h, http.MethodPost, "/sessions/"+sess.ID+"/stop", nil); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	doHTTP(t, h, http.MethodGet, "/modems/IC705FM", &state)
+	if state.Running {
+		t.Fatalf("expected modem to be stopped, got %+v", state)
+	}
+
+	if code := doHTTP(t, h, http.MethodPost, "/sessions/"+sess.ID+"/stop", nil); code != http.StatusNotFound {
+		t.Fatalf("expected stopped session to be gone, got %d", code)
+	}
+}
+
+func TestHTTPSessionSharedWithControlPort(t *testing.T) {
+	p := newTestProgram()
+	p.Modems[0].Cmd = "sleep"
+	p.Modems[0].Args = "10"
+	conn, r, _ := startTestSession(t, p)
+	send(conn, "start IC705FM\n")
+	expectLines(t, conn, r, "OK")
+
+	var state modemState
+	doHTTP(t, p.newHTTPHandler(), http.MethodGet, "/modems/IC705FM", &state)
+	if !state.Running || state.Session.Client != "pipe" {
+		t.Fatalf("expected control port session to be reported, got %+v", state)
+	}
+}
+
+func TestHTTPStopControlPortSession(t *testing.T) {
+	p := newTestProgram()
+	p.Modems[0].Cmd = "sleep"
+	p.Modems[0].Args = "10"
+	p.Modems[0].CatCtrl.Cmd = "sleep"
+	p.Modems[0].CatCtrl.Args = "10"
+	conn, r, done := startTestSession(t, p)
+	send(conn, "start IC705FM\n")
+	expectLines(t, conn, r, "OK")
+
+	h := p.newHTTPHandler()
+	var state modemState
+	doHTTP(t, h, http.MethodGet, "/modems/IC705FM", &state)
+	if state.Session == nil || state.Session.ModemProcess != "running" || state.Session.CatProcess != "running" {
+		t.Fatalf("expected running processes, got %+v", state.Session)
+	}
+
+	if code := doHTTP(t, h, http.MethodPost, "/sessions/"+state.Session.ID+"/stop", nil); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected control connection to be closed")
+	}
+}
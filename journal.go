@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The journal records VARA .ini files that have been swapped for a modem profile.
+// It is written before the swap happens so that, if varanny is killed before the
+// session ends, the original files can be restored on the next startup.
+type journal struct {
+	path string
+	mu   sync.Mutex
+}
+
+type journalEntry struct {
+	Config    string `json:"Config"`    // live VARA .ini file
+	Backup    string `json:"Backup"`    // copy of the original .ini file
+	Installed bool   `json:"Installed"` // profile may have been copied over Config
+}
+
+// The journal lives next to the varanny configuration file, e.g. varanny.json -> varanny.journal
+func journalPath(configPath string) string {
+	ext := filepath.Ext(configPath)
+	return strings.TrimSuffix(configPath, ext) + ".journal"
+}
+
+func newJournal(path string) *journal {
+	return &journal{path: path}
+}
+
+func (j *journal) load() ([]journalEntry, error) {
+	data, err := os.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []journalEntry
+	if len(data) == 0 {
+		return nil, nil
+	}
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt journal %s: %v", j.path, err)
+	}
+	return entries, nil
+}
+
+func (j *journal) save(entries []journalEntry) error {
+	if len(entries) == 0 {
+		err := os.Remove(j.path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(j.path, data)
+}
+
+// Record that config is about to be backed up. Fails if the file is already swapped.
+func (j *journal) add(entry journalEntry) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries, err := j.load()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Config == entry.Config {
+			return fmt.Errorf("config file %s is already in use by another session", entry.Config)
+		}
+	}
+	return j.save(append(entries, entry))
+}
+
+// Record that the profile is being installed over config
+func (j *journal) markInstalled(config string) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries, err := j.load()
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		if entries[i].Config == config {
+			entries[i].Installed = true
+		}
+	}
+	return j.save(entries)
+}
+
+// Forget about config once the original has been restored
+func (j *journal) remove(config string) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries, err := j.load()
+	if err != nil {
+		return err
+	}
+	kept := entries[:0]
+	for _, e := range entries {
+		if e.Config != config {
+			kept = append(kept, e)
+		}
+	}
+	return j.save(kept)
+}
+
+// Restore the original .ini files left behind by an interrupted session. Entries
+// in the journal are replayed first, then stray backups next to the given live
+// .ini files are restored (these may be left behind by older versions). Returns
+// a description of every file that has been recovered.
+func (j *journal) recover(configs []string) ([]string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var recovered []string
+
+	entries, err := j.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var failed []journalEntry
+	for _, e := range entries {
+		if !FileExists(e.Backup) {
+			continue
+		}
+		if e.Installed {
+			err = RestoreFile(e.Backup, e.Config)
+			if err != nil {
+				failed = append(failed, e)
+				log.Println("ERROR cannot restore", e.Config, "from", e.Backup, ":", err)
+				continue
+			}
+			recovered = append(recovered, "restored "+e.Config+" from "+e.Backup)
+		} else {
+			// The profile was never installed, the live file is the original
+			os.Remove(e.Backup)
+			recovered = append(recovered, "discarded incomplete backup "+e.Backup)
+		}
+	}
+	err = j.save(failed)
+	if err != nil {
+		return recovered, err
+	}
+
+	for _, config := range configs {
+		backup := config + ".varanny.bak"
+		if !FileExists(backup) {
+			continue
+		}
+		err = RestoreFile(backup, config)
+		if err != nil {
+			log.Println("ERROR cannot restore", config, "from", backup, ":", err)
+			continue
+		}
+		recovered = append(recovered, "restored "+config+" from "+backup)
+	}
+
+	return recovered, nil
+}
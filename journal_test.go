@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path string, content string) {
+	t.Helper()
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectFileContent(t *testing.T, path string, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("expected %s to contain %q, got %q", path, want, got)
+	}
+}
+
+func TestJournalPath(t *testing.T) {
+	got := journalPath(filepath.Join("etc", "varanny.json"))
+	want := filepath.Join("etc", "varanny.journal")
+	if got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestJournalRecoverInstalled(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "VARA.ini")
+	backup := config + ".varanny.bak"
+	writeTestFile(t, config, "profile")
+	writeTestFile(t, backup, "original")
+
+	j := newJournal(filepath.Join(dir, "varanny.journal"))
+	if err := j.add(journalEntry{Config: config, Backup: backup}); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.markInstalled(config); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := j.recover(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered) != 1 {
+		t.Fatalf("expected one recovered file, got %v", recovered)
+	}
+	expectFileContent(t, config, "original")
+	if FileExists(backup) || FileExists(j.path) {
+		t.Fatal("expected backup and journal to be removed")
+	}
+}
+
+func TestJournalRecoverIncompleteBackup(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "VARA.ini")
+	backup := config + ".varanny.bak"
+	writeTestFile(t, config, "original")
+	writeTestFile(t, backup, "orig")
+
+	j := newJournal(filepath.Join(dir, "varanny.journal"))
+	if err := j.add(journalEntry{Config: config, Backup: backup}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := j.recover(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFileContent(t, config, "original")
+	if FileExists(backup) {
+		t.Fatal("expected partial backup to be discarded")
+	}
+}
+
+func TestJournalRecoverStrayBackup(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "VARA.ini")
+	writeTestFile(t, config, "profile")
+	writeTestFile(t, config+".varanny.bak", "original")
+
+	j := newJournal(filepath.Join(dir, "varanny.journal"))
+	recovered, err := j.recover([]string{config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered) != 1 {
+		t.Fatalf("expected one recovered file, got %v", recovered)
+	}
+	expectFileContent(t, config, "original")
+}
+
+func TestJournalRejectsConcurrentSwap(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "VARA.ini")
+	j := newJournal(filepath.Join(dir, "varanny.journal"))
+	if err := j.add(journalEntry{Config: config, Backup: config + ".varanny.bak"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.add(journalEntry{Config: config, Backup: config + ".varanny.bak"}); err == nil {
+		t.Fatal("expected second swap of the same config file to fail")
+	}
+	if err := j.remove(config); err != nil {
+		t.Fatal(err)
+	}
+	if FileExists(j.path) {
+		t.Fatal("expected empty journal to be removed")
+	}
+}
+
+func TestSessionJournalsConfigSwap(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "VARA.ini")
+	profile := filepath.Join(dir, "VARA.digirig.ini")
+	writeTestFile(t, config, "original")
+	writeTestFile(t, profile, "profile")
+
+	j := newJournal(filepath.Join(dir, "varanny.journal"))
+	modem := &Modem{Name: "HF", Cmd: "sleep", Args: "10", Config: profile, DefaultConfig: config}
+	s := newSession(modem, j)
+	if err := s.start(); err != nil {
+		t.Fatal(err)
+	}
+	expectFileContent(t, config, "profile")
+	entries, err := j.load()
+	if err != nil || len(entries) != 1 || !entries[0].Installed {
+		t.Fatalf("expected an installed journal entry, got %v, %v", entries, err)
+	}
+
+	s.close()
+	expectFileContent(t, config, "original")
+	if FileExists(j.path) {
+		t.Fatal("expected journal to be cleared after restore")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// Size of the per subscriber buffer, levels are dropped for slow subscribers
+const levelBufferSize = 32
+
+// Find the audio input of a modem, as named in its AudioInputName or in its .ini file
+func findModemAudioDevice(modem *Modem, threshold float64) (string, func(chan DbfsLevel, chan bool), error) {
+	// Figure out .ini file name for this modem
+	var varaDefaultConfigFile = modem.DefaultConfig
+	iniFilePath, err := specifiedIniConfigPath(modem, varaDefaultConfigFile)
+	if err != nil {
+		return "", nil, &codedError{errCodeNotFound, err.Error()}
+	}
+
+	audioDeviceName, err := GetInputDeviceName(iniFilePath)
+	if modem.AudioInputName != "" {
+		audioDeviceName = modem.AudioInputName
+	} else if err != nil {
+		return "", nil, &codedError{errCodeAudioDevice, "audio device not found in " + iniFilePath}
+	}
+
+	log.Println("Monitoring audio device '" + audioDeviceName + "' found in " + iniFilePath)
+	device, err := FindAudioDevice(audioDeviceName, threshold)
+	if err != nil {
+		return "", nil, &codedError{errCodeAudioDevice, "audio device '" + audioDeviceName + "' not found"}
+	}
+	run := func(levels chan DbfsLevel, stop chan bool) {
+		Monitor(device, levels, stop)
+	}
+	return device.Name(), run, nil
+}
+
+// Opens the audio input of a modem, returns the device name and a function streaming
+// its levels until stopped. Replaced in tests.
+var openAudioInput = findModemAudioDevice
+
+// A levelMonitor captures the audio input of a modem once and fans out the levels
+// to every subscriber. While it runs it holds a monitor session on the modem so
+// VARA cannot be started on the same sound card.
+type levelMonitor struct {
+	owner       *levelMonitors
+	device      string
+	sess        *session
+	stop        chan bool
+	stopOnce    sync.Once
+	finished    chan struct{}
+	subscribers map[chan DbfsLevel]struct{}
+}
+
+// The level monitors currently running, by modem
+type levelMonitors struct {
+	mu       sync.Mutex
+	monitors map[*Modem]*levelMonitor
+}
+
+func newLevelMonitors() *levelMonitors {
+	return &levelMonitors{monitors: map[*Modem]*levelMonitor{}}
+}
+
+// Subscribe to the audio levels of a modem, starting the capture if this is the first
+// subscriber. Returns the channel of levels, the device name and the function to call
+// to unsubscribe.
+func (p *program) subscribeLevels(modem *Modem, client string) (chan DbfsLevel, string, func(), error) {
+	lm := p.levelMonitors
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	m := lm.monitors[modem]
+	if m == nil {
+		sess, err := p.openSession(modem, client)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		sess.mu.Lock()
+		sess.monitor = true
+		sess.mu.Unlock()
+
+		device, run, err := openAudioInput(modem, p.config().AudioInputNameThreshold)
+		if err != nil {
+			sess.close()
+			return nil, "", nil, err
+		}
+
+		m = &levelMonitor{
+			owner:       lm,
+			device:      device,
+			sess:        sess,
+			stop:        make(chan bool),
+			finished:    make(chan struct{}),
+			subscribers: map[chan DbfsLevel]struct{}{},
+		}
+		lm.monitors[modem] = m
+		m.start(run)
+
+		// The session can be killed by an admin, end the capture with it
+		go func() {
+			<-sess.closed
+			m.shutdown(modem)
+		}()
+	}
+
+	levels := make(chan DbfsLevel, levelBufferSize)
+	m.subscribers[levels] = struct{}{}
+	log.Println("Audio level subscriber added for", modem.Name, "total", len(m.subscribers))
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			lm.mu.Lock()
+			delete(m.subscribers, levels)
+			last := len(m.subscribers) == 0 && lm.monitors[modem] == m
+			if last {
+				delete(lm.monitors, modem)
+			}
+			lm.mu.Unlock()
+
+			if last {
+				log.Println("Last audio level subscriber gone, stopping monitor for", modem.Name)
+				m.shutdown(modem)
+			}
+		})
+	}
+	return levels, m.device, unsubscribe, nil
+}
+
+// Run the capture and pump the levels to the subscribers. The capture callback blocks
+// on a full channel, so levels are drained until the capture has fully stopped.
+func (m *levelMonitor) start(run func(chan DbfsLevel, chan bool)) {
+	levels := make(chan DbfsLevel, levelBufferSize)
+	captureDone := make(chan struct{})
+
+	go func() {
+		defer close(captureDone)
+		run(levels, m.stop)
+	}()
+
+	go func() {
+		defer close(m.finished)
+		for {
+			select {
+			case level := <-levels:
+				m.publish(level)
+			case <-captureDone:
+				return
+			}
+		}
+	}()
+}
+
+// Stop the capture and close the monitor session. The channels of the subscribers
+// still attached are closed. Safe to call more than once.
+func (m *levelMonitor) shutdown(modem *Modem) {
+	m.stopOnce.Do(func() {
+		lm := m.owner
+		lm.mu.Lock()
+		if lm.monitors[modem] == m {
+			delete(lm.monitors, modem)
+		}
+		lm.mu.Unlock()
+
+		close(m.stop)
+		<-m.finished
+
+		lm.mu.Lock()
+		for levels := range m.subscribers {
+			delete(m.subscribers, levels)
+			close(levels)
+		}
+		lm.mu.Unlock()
+		m.sess.close()
+	})
+}
+
+func (m *levelMonitor) publish(level DbfsLevel) {
+	m.owner.mu.Lock()
+	defer m.owner.mu.Unlock()
+	for levels := range m.subscribers {
+		select {
+		case levels <- level:
+		default:
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Replace the audio capture with a generator emitting a constant level
+func fakeAudioInput(t *testing.T, level float64) *int32 {
+	var captures int32
+	saved := openAudioInput
+	openAudioInput = func(modem *Modem, threshold float64) (string, func(chan DbfsLevel, chan bool), error) {
+		run := func(levels chan DbfsLevel, stop chan bool) {
+			atomic.AddInt32(&captures, 1)
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(10 * time.Millisecond):
+					levels <- DbfsLevel{level}
+				}
+			}
+		}
+		return "Fake USB Audio", run, nil
+	}
+	t.Cleanup(func() { openAudioInput = saved })
+	return &captures
+}
+
+func TestSubscribeLevelsFanOut(t *testing.T) {
+	captures := fakeAudioInput(t, -20)
+	p := newTestProgram()
+	modem := p.Modems[0]
+
+	a, device, unsubscribeA, err := p.subscribeLevels(modem, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device != "Fake USB Audio" {
+		t.Fatalf("unexpected device %q", device)
+	}
+	b, _, unsubscribeB, err := p.subscribeLevels(modem, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, levels := range []chan DbfsLevel{a, b} {
+		select {
+		case level := <-levels:
+			if level.Level != -20 {
+				t.Fatalf("unexpected level %v", level.Level)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no level received")
+		}
+	}
+	if atomic.LoadInt32(captures) != 1 {
+		t.Fatalf("expected a single capture, got %d", atomic.LoadInt32(captures))
+	}
+
+	if _, err := p.openSession(modem, "c"); err == nil {
+		t.Fatal("expected modem to be held while monitoring")
+	}
+
+	unsubscribeA()
+	if p.sessions.forModem(modem) == nil {
+		t.Fatal("expected monitor to keep running for remaining subscriber")
+	}
+	unsubscribeB()
+	if p.sessions.forModem(modem) != nil {
+		t.Fatal("expected monitor session to be closed after last subscriber left")
+	}
+}
+
+// Run with -race, the session is listed while the monitor flag is set
+func TestMonitorSessionListedWhileSubscribing(t *testing.T) {
+	fakeAudioInput(t, -20)
+	p := newTestProgram()
+
+	listed := make(chan bool, 1)
+	go func() {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			for _, s := range p.sessions.list() {
+				if newSessionPayload(s).Monitor {
+					listed <- true
+					return
+				}
+			}
+		}
+		listed <- false
+	}()
+
+	_, _, unsubscribe, err := p.subscribeLevels(p.Modems[0], "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+	if !<-listed {
+		t.Fatal("expected a monitor session to be listed")
+	}
+}
+
+func TestHandleConnectionMonitor(t *testing.T) {
+	fakeAudioInput(t, -12.34)
+	conn, r, _ := startTestSession(t, newTestProgram())
+	send(conn, "monitor IC705FM\n")
+	expectLines(t, conn, r, "OK", "Fake USB Audio", "-12.3")
+}
+
+func TestHTTPLevelsStream(t *testing.T) {
+	fakeAudioInput(t, -6)
+	p := newTestProgram()
+	srv := httptest.NewServer(p.newHTTPHandler())
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/modems/IC705FM/levels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	r := bufio.NewReader(res.Body)
+	var lines []string
+	for len(lines) < 6 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	if lines[0] != "event: monitor" || !strings.Contains(lines[1], `"device":"Fake USB Audio"`) {
+		t.Fatalf("unexpected monitor event %q", lines[:2])
+	}
+	if lines[3] != "event: level" || !strings.Contains(lines[4], `"level":-6`) {
+		t.Fatalf("unexpected level event %q", lines[3:5])
+	}
+}
+
+func TestKillMonitorSession(t *testing.T) {
+	captures := fakeAudioInput(t, -20)
+	p := newTestProgram()
+	conn, r, done := startTestSession(t, p)
+	send(conn, "monitor IC705FM\n")
+	expectLines(t, conn, r, "OK", "Fake USB Audio")
+
+	p.sessions.forModem(p.Modems[0]).close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("monitoring connection not closed after its session was killed")
+	}
+
+	// The capture is restarted by the next subscriber
+	_, _, unsubscribe, err := p.subscribeLevels(p.Modems[0], "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsubscribe()
+	if atomic.LoadInt32(captures) != 2 {
+		t.Fatalf("expected a new capture, got %d", atomic.LoadInt32(captures))
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"sort"
+)
+
+// Environment of a modem or CAT control process, on top of the one varanny runs in.
+// ${VAR} and $VAR references to the environment of varanny are expanded, e.g.
+// "WinePrefix": "${HOME}/.wine-hf".
+type ProcessEnv struct {
+	Env map[string]string `json:"Env"`
+	// Working directory, the directory of the executable when not set
+	WorkDir string `json:"WorkDir"`
+	// Sets WINEPREFIX so modems can run in separate Wine installations
+	WinePrefix string `json:"WinePrefix"`
+}
+
+// Variables added to the environment of the process, sorted by name with
+// WINEPREFIX first so Env can override it
+func (e ProcessEnv) variables() []string {
+	var vars []string
+	if e.WinePrefix != "" {
+		vars = append(vars, "WINEPREFIX="+os.ExpandEnv(e.WinePrefix))
+	}
+	names := make([]string, 0, len(e.Env))
+	for name := range e.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		vars = append(vars, name+"="+os.ExpandEnv(e.Env[name]))
+	}
+	return vars
+}
+
+// Apply the environment and working directory to cmd. The variables only affect
+// this process, later ones win over the environment of varanny.
+func (e ProcessEnv) apply(cmd *exec.Cmd) {
+	cmd.Env = append(cmd.Env, e.variables()...)
+	if e.WorkDir != "" {
+		cmd.Dir = os.ExpandEnv(e.WorkDir)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessEnvVariables(t *testing.T) {
+	os.Setenv("VARANNY_TEST_HOME", "/home/pi")
+	defer os.Unsetenv("VARANNY_TEST_HOME")
+
+	e := ProcessEnv{
+		WinePrefix: "${VARANNY_TEST_HOME}/.wine-hf",
+		Env:        map[string]string{"WINEDEBUG": "-all", "DISPLAY": ":0", "VARA_HOME": "$VARANNY_TEST_HOME/vara"},
+	}
+	got := strings.Join(e.variables(), " ")
+	want := "WINEPREFIX=/home/pi/.wine-hf DISPLAY=:0 VARA_HOME=/home/pi/vara WINEDEBUG=-all"
+	if got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	cmd := exec.Command("true")
+	cmd.Env = []string{"WINEPREFIX=/root/.wine"}
+	cmd.Dir = "/usr/bin"
+	ProcessEnv{WorkDir: "${VARANNY_TEST_HOME}"}.apply(cmd)
+	if cmd.Dir != "/home/pi" || len(cmd.Env) != 1 {
+		t.Fatalf("unexpected command %q in %s", cmd.Env, cmd.Dir)
+	}
+}
+
+func TestStartWithProcessEnv(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestProgram()
+	modem := p.Modems[0]
+	modem.Cmd = "sh"
+	modem.Args = CommandArgs(quoteArgs([]string{"-c", `echo "$WINEPREFIX $WINEDEBUG" > "$(pwd)/env.txt"`}))
+	modem.ProcessEnv = ProcessEnv{
+		WinePrefix: filepath.Join(dir, "wine-hf"),
+		Env:        map[string]string{"WINEDEBUG": "-all"},
+		WorkDir:    dir,
+	}
+
+	sess, err := p.openSession(modem, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	err = sess.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "env.txt")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		content, err := os.ReadFile(path)
+		if err == nil && strings.HasSuffix(string(content), "\n") {
+			if string(content) != filepath.Join(dir, "wine-hf")+" -all\n" {
+				t.Fatalf("unexpected environment %q", content)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("modem did not run in its working directory")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if os.Getenv("WINEDEBUG") == "-all" {
+		t.Fatal("the environment of varanny must not change")
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Start the process in its own process group so it can be terminated along with
+// its children, e.g. the VARA.exe and wineserver processes spawned by wine
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Send a signal to every process of the group led by cmd
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	err := syscall.Kill(-cmd.Process.Pid, sig)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
+
+// Is any process of the group led by cmd still alive
+func processGroupAlive(cmd *exec.Cmd) bool {
+	return syscall.Kill(-cmd.Process.Pid, 0) == nil
+}
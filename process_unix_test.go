@@ -0,0 +1,120 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCloseKillsProcessGroup(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "pid")
+	p := newTestProgram()
+	modem := p.Modems[0]
+	// Like wine, return right away and leave the real program running
+	modem.Cmd = "sh"
+	modem.Args = CommandArgs(quoteArgs([]string{"-c", `sleep 30 & echo $! > "` + pidFile + `"`}))
+
+	sess, err := p.openSession(modem, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sess.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pid int
+	deadline := time.Now().Add(2 * time.Second)
+	for pid == 0 {
+		content, _ := os.ReadFile(pidFile)
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(content)))
+		if time.Now().After(deadline) {
+			t.Fatal("background process not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sess.close()
+	if processRunning(pid) {
+		t.Fatal("expected the background process to be terminated with the session")
+	}
+}
+
+func TestTerminateProcessKillsAfterGracePeriod(t *testing.T) {
+	ready := filepath.Join(t.TempDir(), "ready")
+	cmd := createCommand(os.Stderr, "sh", "-c", `trap "" TERM; touch "`+ready+`"; sleep 30`)
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for !FileExists(ready) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	done := make(chan struct{})
+	go func() {
+		cmd.Process.Wait()
+		close(done)
+	}()
+
+	started := time.Now()
+	terminateProcess(cmd, done, "test", 200*time.Millisecond)
+	if elapsed := time.Since(started); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("expected the process to be killed after the grace period, took %v", elapsed)
+	}
+	// Killed children may take a moment to be reaped by init
+	deadline := time.Now().Add(5 * time.Second)
+	for processGroupAlive(cmd) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the whole group to be killed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Is the process alive, zombies waiting to be reaped do not count
+func processRunning(pid int) bool {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if os.IsNotExist(err) && !FileExists("/proc/self") {
+		return syscall.Kill(pid, 0) == nil
+	}
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat))
+	return len(fields) > 2 && fields[2] != "Z"
+}
+
+func TestCloseKillsWineserver(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "wineserver.txt")
+	writeTestFile(t, filepath.Join(dir, "wineserver"), "#!/bin/sh\necho \"$WINEPREFIX $1\" > \""+out+"\"\n")
+	err := os.Chmod(filepath.Join(dir, "wineserver"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	p := newQueueTestProgram()
+	modem := p.Modems[0]
+	modem.KillWineserver = true
+	modem.WinePrefix = filepath.Join(dir, "wine-fm")
+
+	sess, err := p.openSession(modem, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sess.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.close()
+	expectFileContent(t, out, filepath.Join(dir, "wine-fm")+" -k\n")
+}
@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// Process groups cannot be signaled on Windows, the process is killed on its own
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if sig != syscall.SIGKILL {
+		return errors.New("not supported on windows")
+	}
+	return cmd.Process.Kill()
+}
+
+func processGroupAlive(cmd *exec.Cmd) bool {
+	return false
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum length of a command line sent on the control port, line terminator included
+const maxCommandLength = 1024
+
+var errCommandTooLong = errors.New("command too long")
+
+// Commands are newline terminated. A trailing carriage return is dropped so telnet
+// clients sending CRLF are supported. Several commands can arrive in a single
+// packet and a command can be split across packets.
+func newCommandReader(conn io.Reader) *bufio.Reader {
+	return bufio.NewReaderSize(conn, maxCommandLength)
+}
+
+// Read the next command line. Lines longer than maxCommandLength are consumed up to
+// their terminator and reported as errCommandTooLong so the session can carry on.
+func readCommand(r *bufio.Reader) (string, error) {
+	line, isPrefix, err := r.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if !isPrefix {
+		return strings.TrimSpace(string(line)), nil
+	}
+
+	// Discard the remainder of the oversized line
+	for isPrefix {
+		_, isPrefix, err = r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", errCommandTooLong
+}
+
+// Error codes reported in the error_code field of json responses
+const (
+	errCodeInvalidCommand = "invalid_command"
+	errCodeCommandTooLong = "command_too_long"
+	errCodeNotFound       = "not_found"
+	errCodeBusy           = "busy"
+	errCodeStartFailed    = "start_failed"
+	errCodeAudioDevice    = "audio_device"
+	errCodeInvalidProto   = "invalid_proto"
+	errCodeUnauthorized   = "unauthorized"
+	errCodeAuthFailed     = "auth_failed"
+	errCodeAmbiguous      = "ambiguous"
+)
+
+// An error carrying the code reported to clients
+type codedError struct {
+	code    string
+	message string
+}
+
+func (e *codedError) Error() string {
+	return e.message
+}
+
+// A modem name matching several modems
+type ambiguousError struct {
+	name       string
+	candidates []string
+}
+
+func (e *ambiguousError) Error() string {
+	return "ambiguous modem name '" + e.name + "', candidates: " + strings.Join(e.candidates, ", ")
+}
+
+// Return the code to report to clients for err
+func errorCode(err error, fallback string) string {
+	switch e := err.(type) {
+	case *codedError:
+		return e.code
+	case *busyError, *busyTimeoutError, *conflictError:
+		return errCodeBusy
+	case *ambiguousError:
+		return errCodeAmbiguous
+	}
+	return fallback
+}
+
+// A single line json response
+type response struct {
+	Status    string         `json:"status"` // "ok" or "error"
+	Type      string         `json:"type,omitempty"`
+	ErrorCode string         `json:"error_code,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Proto     string         `json:"proto,omitempty"`
+	Challenge string         `json:"challenge,omitempty"`
+	Version   string         `json:"version,omitempty"`
+	Modems    []string       `json:"modems,omitempty"`
+	Config    *configPayload `json:"config,omitempty"`
+	Device    string         `json:"device,omitempty"`
+	Level     *float64       `json:"level,omitempty"`
+	Event     string         `json:"event,omitempty"`
+	ExitCode  *int           `json:"exit_code,omitempty"`
+	// Modem names an ambiguous name could refer to
+	Candidates []string `json:"candidates,omitempty"`
+	// Position in the queue of a busy modem, starting at 1
+	Position int `json:"position,omitempty"`
+	// Open sessions, see the sessions command
+	Sessions []*sessionPayload `json:"sessions,omitempty"`
+}
+
+type configPayload struct {
+	Path   string         `json:"path"`
+	Modems []modemPayload `json:"modems"`
+}
+
+type modemPayload struct {
+	Name    string         `json:"name"`
+	Type    string         `json:"type"`
+	Cmd     string         `json:"cmd"`
+	Args    string         `json:"args"`
+	Config  string         `json:"config"`
+	Port    int            `json:"port"`
+	CatCtrl catCtrlPayload `json:"cat_ctrl"`
+}
+
+type catCtrlPayload struct {
+	Port    int    `json:"port"`
+	Dialect string `json:"dialect"`
+	Cmd     string `json:"cmd"`
+	Args    string `json:"args"`
+}
+
+// The responder formats replies to the client, either as the legacy text lines or
+// as one json object per line once the client negotiated it with "proto json".
+// It is safe for concurrent use.
+type responder struct {
+	w    io.Writer
+	mu   sync.Mutex
+	json bool
+}
+
+func newResponder(w io.Writer) *responder {
+	return &responder{w: w}
+}
+
+func (r *responder) setJSON(enabled bool) {
+	r.mu.Lock()
+	r.json = enabled
+	r.mu.Unlock()
+}
+
+// Write either the text lines or the json response depending on the negotiated protocol
+func (r *responder) send(resp response, lines ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.json {
+		data, err := json.Marshal(resp)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		r.w.Write(append(data, '\n'))
+		return
+	}
+
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	r.w.Write([]byte(b.String()))
+}
+
+func (r *responder) ok() {
+	r.send(response{Status: "ok"}, "OK")
+}
+
+func (r *responder) error(code string, message string) {
+	log.Println("ERROR " + message)
+	r.send(response{Status: "error", ErrorCode: code, Error: message}, "ERROR "+message)
+}
+
+// Report err using its own code when it has one
+func (r *responder) fail(err error, fallback string) {
+	if e, ok := err.(*ambiguousError); ok {
+		log.Println("ERROR " + e.Error())
+		r.send(response{Status: "error", ErrorCode: errCodeAmbiguous, Error: e.Error(), Candidates: e.candidates}, "ERROR "+e.Error())
+		return
+	}
+	r.error(errorCode(err, fallback), err.Error())
+}
+
+func (r *responder) invalidCommand() {
+	r.send(response{Status: "error", ErrorCode: errCodeInvalidCommand, Error: "invalid command"}, "Invalid command")
+}
+
+func (r *responder) queued(position int) {
+	r.send(response{Status: "ok", Type: "queued", Position: position}, "QUEUED position="+strconv.Itoa(position))
+}
+
+func (r *responder) pong() {
+	r.send(response{Status: "ok", Type: "pong"}, "PONG")
+}
+
+func (r *responder) proto(name string) {
+	r.send(response{Status: "ok", Type: "proto", Proto: name}, "OK")
+}
+
+func (r *responder) challenge(c string) {
+	r.send(response{Status: "ok", Type: "challenge", Challenge: c}, "OK", c)
+}
+
+func (r *responder) version(v string) {
+	r.send(response{Status: "ok", Type: "version", Version: v}, "OK", v)
+}
+
+func (r *responder) list(names []string) {
+	r.send(response{Status: "ok", Type: "list", Modems: names}, append([]string{"OK"}, names...)...)
+}
+
+// One line per session: id, client, start time, last activity and modem name last
+// as it may contain spaces
+func (r *responder) sessions(sessions []*sessionPayload) {
+	lines := []string{"OK"}
+	for _, s := range sessions {
+		lines = append(lines, strings.Join([]string{
+			s.ID,
+			s.Client,
+			s.Started.Format(time.RFC3339),
+			s.LastActivity.Format(time.RFC3339),
+			s.Modem,
+		}, " "))
+	}
+	r.send(response{Status: "ok", Type: "sessions", Sessions: sessions}, lines...)
+}
+
+func (r *responder) config(c configPayload) {
+	lines := []string{"OK", "Config path: " + c.Path}
+	for _, m := range c.Modems {
+		lines = append(lines,
+			m.Name,
+			"  Type: "+m.Type,
+			"  Cmd: "+m.Cmd,
+			"  Args: "+m.Args,
+			"  Config: "+m.Config,
+			"  CatCtrl.Port: "+strconv.Itoa(m.CatCtrl.Port),
+			"  CatCtrl.Dialect: "+m.CatCtrl.Dialect,
+			"  CatCtrl.Cmd: "+m.CatCtrl.Cmd,
+			"  CatCtrl.Args: "+m.CatCtrl.Args,
+		)
+	}
+	r.send(response{Status: "ok", Type: "config", Config: &c}, lines...)
+}
+
+func (r *responder) monitor(device string) {
+	r.send(response{Status: "ok", Type: "monitor", Device: device}, "OK", device)
+}
+
+func (r *responder) level(dbfs float64) {
+	r.send(response{Status: "ok", Type: "level", Level: &dbfs}, fmt.Sprintf("%.1f", dbfs))
+}
+
+func (r *responder) event(e sessionEvent) {
+	code := e.ExitCode
+	r.send(response{Status: "ok", Type: "event", Event: e.Name, ExitCode: &code},
+		fmt.Sprintf("EVENT %s %d", e.Name, e.ExitCode))
+}
+
+func newConfigPayload(path string, modems []*Modem) configPayload {
+	c := configPayload{Path: path, Modems: []modemPayload{}}
+	for _, m := range modems {
+		c.Modems = append(c.Modems, modemPayload{
+			Name:   m.Name,
+			Type:   m.Type,
+			Cmd:    m.Cmd,
+			Args:   string(m.Args),
+			Config: m.Config,
+			Port:   m.Port,
+			CatCtrl: catCtrlPayload{
+				Port:    m.CatCtrl.Port,
+				Dialect: m.CatCtrl.Dialect,
+				Cmd:     m.CatCtrl.Cmd,
+				Args:    string(m.CatCtrl.Args),
+			},
+		})
+	}
+	return c
+}
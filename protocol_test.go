@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestProgram() *program {
+	delay := 0
+	return &program{
+		ctx:           context.Background(),
+		sessions:      newSessionRegistry(),
+		levelMonitors: newLevelMonitors(),
+		queues:        newWaitQueues(),
+		resources:     newResourceLocks(),
+		Config: &Config{
+			Delay: &delay,
+			Modems: []*Modem{
+				{Name: "IC705FM", Type: "fm", Cmd: "echo"},
+				{Name: "IC705HF", Type: "hf", Cmd: "echo"},
+			},
+		},
+	}
+}
+
+// Start a session over an in-memory connection and return the client side
+func startTestSession(t *testing.T, p *program) (net.Conn, *bufio.Reader, chan struct{}) {
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(server, p)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Error("handleConnection did not return after client closed")
+		}
+	})
+	return client, bufio.NewReader(client), done
+}
+
+// Writes on a pipe block until the server reads, so send asynchronously
+func send(conn net.Conn, data string) {
+	go conn.Write([]byte(data))
+}
+
+func expectLines(t *testing.T, conn net.Conn, r *bufio.Reader, want ...string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, w := range want {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected %q, got error %v", w, err)
+		}
+		if got := strings.TrimSuffix(line, "\n"); got != w {
+			t.Fatalf("expected %q, got %q", w, got)
+		}
+	}
+}
+
+func TestReadCommandCRLF(t *testing.T) {
+	r := newCommandReader(strings.NewReader("version\r\nlist\n"))
+	for _, want := range []string{"version", "list"} {
+		got, err := readCommand(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+func TestReadCommandTooLong(t *testing.T) {
+	r := newCommandReader(strings.NewReader(strings.Repeat("a", 3*maxCommandLength) + "\nversion\n"))
+	_, err := readCommand(r)
+	if err != errCommandTooLong {
+		t.Fatalf("expected errCommandTooLong, got %v", err)
+	}
+	got, err := readCommand(r)
+	if err != nil || got != "version" {
+		t.Fatalf("expected version after oversized line, got %q, %v", got, err)
+	}
+}
+
+func TestHandleConnectionSeveralCommandsInOnePacket(t *testing.T) {
+	conn, r, _ := startTestSession(t, newTestProgram())
+	send(conn, "version\r\nlist\r\n")
+	expectLines(t, conn, r, "OK", version, "OK", "IC705FM", "IC705HF")
+}
+
+func TestHandleConnectionCommandSplitAcrossPackets(t *testing.T) {
+	conn, r, _ := startTestSession(t, newTestProgram())
+	conn.Write([]byte("ver"))
+	conn.Write([]byte("sion"))
+	send(conn, "\n")
+	expectLines(t, conn, r, "OK", version)
+}
+
+func TestHandleConnectionOversizedLine(t *testing.T) {
+	conn, r, _ := startTestSession(t, newTestProgram())
+	send(conn, strings.Repeat("x", 2*maxCommandLength)+"\nversion\n")
+	expectLines(t, conn, r, "ERROR command too long", "OK", version)
+}
+
+func TestHandleConnectionInvalidCommand(t *testing.T) {
+	conn, r, _ := startTestSession(t, newTestProgram())
+	send(conn, "\nbogus\n")
+	expectLines(t, conn, r, "Invalid command")
+}
+
+func TestHandleConnectionStop(t *testing.T) {
+	conn, r, done := startTestSession(t, newTestProgram())
+	send(conn, "stop\n")
+	expectLines(t, conn, r, "OK")
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session did not end after stop")
+	}
+}
+
+func TestHandleConnectionModemExitEvent(t *testing.T) {
+	p := newTestProgram()
+	p.Modems[0].Cmd = "false"
+	conn, r, _ := startTestSession(t, p)
+	send(conn, "start IC705FM\n")
+	expectLines(t, conn, r, "OK", "EVENT modem-exited 1")
+	send(conn, "version\n")
+	expectLines(t, conn, r, "OK", version)
+}
+
+func TestHandleConnectionEndSessionOnExit(t *testing.T) {
+	p := newTestProgram()
+	p.Modems[0].Cmd = "false"
+	p.EndSessionOnExit = true
+	conn, r, done := startTestSession(t, p)
+	send(conn, "start IC705FM\n")
+	expectLines(t, conn, r, "OK", "EVENT modem-exited 1")
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session did not end after modem exited")
+	}
+}
+
+func TestHandleConnectionModemAlreadyRunning(t *testing.T) {
+	p := newTestProgram()
+	p.Modems[0].Cmd = "sleep"
+	p.Modems[0].Args = "10"
+	conn, r, _ := startTestSession(t, p)
+	send(conn, "start IC705FM\n")
+	expectLines(t, conn, r, "OK")
+
+	other, otherReader, done := startTestSession(t, p)
+	send(other, "start IC705FM\n")
+	expectLines(t, other, otherReader, "ERROR modem IC705FM is already running")
+	<-done
+}
+
+func expectJSON(t *testing.T, conn net.Conn, r *bufio.Reader) response {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("expected a json response, got error %v", err)
+	}
+	var resp response
+	err = json.Unmarshal(line, &resp)
+	if err != nil {
+		t.Fatalf("invalid json response %q: %v", line, err)
+	}
+	return resp
+}
+
+func TestHandleConnectionJSONMode(t *testing.T) {
+	conn, r, _ := startTestSession(t, newTestProgram())
+	send(conn, "proto json\nversion\nlist\nconfig\nbogus\n")
+
+	resp := expectJSON(t, conn, r)
+	if resp.Status != "ok" || resp.Proto != "json" {
+		t.Fatalf("unexpected proto response %+v", resp)
+	}
+
+	resp = expectJSON(t, conn, r)
+	if resp.Status != "ok" || resp.Type != "version" || resp.Version != version {
+		t.Fatalf("unexpected version response %+v", resp)
+	}
+
+	resp = expectJSON(t, conn, r)
+	if resp.Type != "list" || len(resp.Modems) != 2 || resp.Modems[0] != "IC705FM" {
+		t.Fatalf("unexpected list response %+v", resp)
+	}
+
+	resp = expectJSON(t, conn, r)
+	if resp.Type != "config" || resp.Config == nil || len(resp.Config.Modems) != 2 || resp.Config.Modems[1].Type != "hf" {
+		t.Fatalf("unexpected config response %+v", resp)
+	}
+
+	resp = expectJSON(t, conn, r)
+	if resp.Status != "error" || resp.ErrorCode != errCodeInvalidCommand {
+		t.Fatalf("unexpected invalid command response %+v", resp)
+	}
+}
+
+func TestHandleConnectionJSONErrors(t *testing.T) {
+	p := newTestProgram()
+	p.Modems[0].Cmd = "false"
+	conn, r, _ := startTestSession(t, p)
+	send(conn, "proto json\n")
+	expectJSON(t, conn, r)
+
+	send(conn, strings.Repeat("x", 2*maxCommandLength)+"\n")
+	resp := expectJSON(t, conn, r)
+	if resp.ErrorCode != errCodeCommandTooLong {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	send(conn, "start IC705FM\n")
+	resp = expectJSON(t, conn, r)
+	if resp.Status != "ok" {
+		t.Fatalf("unexpected start response %+v", resp)
+	}
+	resp = expectJSON(t, conn, r)
+	if resp.Type != "event" || resp.Event != eventModemExited || resp.ExitCode == nil || *resp.ExitCode != 1 {
+		t.Fatalf("unexpected event %+v", resp)
+	}
+}
+
+func TestHandleConnectionJSONNotFound(t *testing.T) {
+	conn, r, done := startTestSession(t, newTestProgram())
+	send(conn, "proto json\nstart nothing\n")
+	expectJSON(t, conn, r)
+	resp := expectJSON(t, conn, r)
+	if resp.Status != "error" || resp.ErrorCode != errCodeNotFound {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	<-done
+}
+
+func TestHandleConnectionAmbiguousModem(t *testing.T) {
+	p := newTestProgram()
+	conn, r, _ := startTestSession(t, p)
+	send(conn, "proto json\nmonitor ic705\n")
+	expectJSON(t, conn, r)
+	resp := expectJSON(t, conn, r)
+	if resp.ErrorCode != errCodeAmbiguous || len(resp.Candidates) != 2 || resp.Candidates[1] != "IC705HF" {
+		t.Fatalf("unexpected ambiguous response %+v", resp)
+	}
+}
+
+func TestHandleConnectionCaseInsensitiveStart(t *testing.T) {
+	p := newTestProgram()
+	conn, r, _ := startTestSession(t, p)
+	send(conn, "start ic705f\n")
+	expectLines(t, conn, r, "OK")
+	if p.sessions.forModem(p.Modems[0]) == nil {
+		t.Fatal("expected IC705FM to be started")
+	}
+}
+
+func TestHandleConnectionBackToTextMode(t *testing.T) {
+	conn, r, _ := startTestSession(t, newTestProgram())
+	send(conn, "proto json\nproto text\nlist\n")
+	expectJSON(t, conn, r)
+	expectLines(t, conn, r, "OK", "OK", "IC705FM", "IC705HF")
+}
+
+func TestHandleConnectionSessionsAndKill(t *testing.T) {
+	p := newQueueTestProgram()
+	holder, holderReader, holderDone := startTestSession(t, p)
+	send(holder, "start IC705FM\n")
+	expectLines(t, holder, holderReader, "OK")
+
+	admin, adminReader, _ := startTestSession(t, p)
+	send(admin, "proto json\nsessions\n")
+	expectJSON(t, admin, adminReader)
+	resp := expectJSON(t, admin, adminReader)
+	if len(resp.Sessions) != 1 || resp.Sessions[0].ID != "1" || resp.Sessions[0].Modem != "IC705FM" || resp.Sessions[0].LastActivity.IsZero() {
+		t.Fatalf("unexpected sessions %+v", resp)
+	}
+
+	send(admin, "proto text\nkill 7\nkill 1\n")
+	expectLines(t, admin, adminReader, "OK", "ERROR session '7' not found", "OK")
+
+	select {
+	case <-holderDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("killed session did not close its connection")
+	}
+	if p.sessions.forModem(p.Modems[0]) != nil {
+		t.Fatal("expected the session to be gone")
+	}
+	if !p.Modems[0].mu.TryLock() {
+		t.Fatal("IC705FM still locked after kill")
+	}
+	p.Modems[0].mu.Unlock()
+}
+
+func TestResponderSessionsText(t *testing.T) {
+	var b strings.Builder
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	newResponder(&b).sessions([]*sessionPayload{
+		{ID: "3", Client: "10.0.0.2:5123", Modem: "Digirig FM", Started: started, LastActivity: started.Add(time.Minute)},
+	})
+	if b.String() != "OK\n3 10.0.0.2:5123 2024-05-01T12:00:00Z 2024-05-01T12:01:00Z Digirig FM\n" {
+		t.Fatalf("unexpected output %q", b.String())
+	}
+}
+
+func TestHandleConnectionPing(t *testing.T) {
+	conn, r, _ := startTestSession(t, newTestProgramWithSecret())
+	send(conn, "ping\nproto json\nping\n")
+	expectLines(t, conn, r, "PONG")
+	expectJSON(t, conn, r)
+	if resp := expectJSON(t, conn, r); resp.Status != "ok" || resp.Type != "pong" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
+
+func TestHandleConnectionIdleTimeout(t *testing.T) {
+	p := newQueueTestProgram()
+	p.IdleTimeout = 1
+	conn, r, done := startTestSession(t, p)
+	send(conn, "start IC705FM\n")
+	expectLines(t, conn, r, "OK")
+
+	// Pings keep the connection alive
+	for i := 0; i < 3; i++ {
+		time.Sleep(500 * time.Millisecond)
+		send(conn, "ping\n")
+		expectLines(t, conn, r, "PONG")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("idle connection not closed")
+	}
+	if p.sessions.forModem(p.Modems[0]) != nil {
+		t.Fatal("expected the idle session to be torn down")
+	}
+}
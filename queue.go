@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interval between the QUEUED lines sent to waiting clients
+var queueNotifyInterval = 10 * time.Second
+
+var errLeftQueue = errors.New("left the queue")
+
+// A client waiting for a busy modem
+type waiter struct {
+	client  string
+	granted chan queueResult // receives the session opened on its behalf
+}
+
+// Clients waiting for busy modems, in arrival order. A modem with waiters is never
+// unlocked, a closing session hands it over to the first waiter instead so clients
+// that did not queue cannot jump ahead.
+type waitQueues struct {
+	mu      sync.Mutex
+	waiters map[*Modem][]*waiter
+}
+
+func newWaitQueues() *waitQueues {
+	return &waitQueues{waiters: map[*Modem][]*waiter{}}
+}
+
+// Result of waiting for a modem
+type queueResult struct {
+	sess *session
+	err  error
+}
+
+// Hand a modem released by its session over to the next waiter, or unlock it. A waiter
+// that cannot get the resources of the modem is told so and the next one is tried.
+func (q *waitQueues) release(p *program, modem *Modem) {
+	if q == nil {
+		modem.mu.Unlock()
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.waiters[modem]) > 0 {
+		w := q.waiters[modem][0]
+		q.remove(modem, w)
+		sess, err := p.registerSession(modem, w.client)
+		w.granted <- queueResult{sess, err}
+		if err == nil {
+			log.Println("Handed", modem.Name, "over to queued client", w.client)
+			return
+		}
+	}
+	modem.mu.Unlock()
+}
+
+// Remove a waiter, must be called with q.mu held. Returns false if it was not queued.
+func (q *waitQueues) remove(modem *Modem, w *waiter) bool {
+	waiters := q.waiters[modem]
+	for i := range waiters {
+		if waiters[i] == w {
+			waiters = append(waiters[:i:i], waiters[i+1:]...)
+			if len(waiters) == 0 {
+				delete(q.waiters, modem)
+			} else {
+				q.waiters[modem] = waiters
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Position of a waiter in the queue of a modem, starting at 1. 0 if not queued.
+func (q *waitQueues) position(modem *Modem, w *waiter) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, other := range q.waiters[modem] {
+		if other == w {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Open a session on a modem, waiting in line if it is busy. The position in the queue
+// is reported to notify when joining and then periodically. Gives up after timeout,
+// if not zero, or when cancel is closed. Exactly one result is delivered on the
+// returned channel.
+func (p *program) queueForModem(modem *Modem, client string, timeout time.Duration, notify func(int), cancel <-chan bool) chan queueResult {
+	result := make(chan queueResult, 1)
+	go func() {
+		result <- p.waitForModem(modem, client, timeout, notify, cancel)
+	}()
+	return result
+}
+
+func (p *program) waitForModem(modem *Modem, client string, timeout time.Duration, notify func(int), cancel <-chan bool) queueResult {
+	q := p.queues
+	ticker := time.NewTicker(queueNotifyInterval)
+	defer ticker.Stop()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	// Wait for ready to fire, reporting the position until then. Returns the error
+	// to give up with, if any.
+	wait := func(ready <-chan struct{}, position func() int) error {
+		for {
+			select {
+			case <-ready:
+				return nil
+			case <-ticker.C:
+				if n := position(); n > 0 {
+					notify(n)
+				}
+			case <-deadline:
+				return &busyTimeoutError{modem.Name, timeout}
+			case <-cancel:
+				log.Println("Client", client, "left the queue for", modem.Name)
+				return errLeftQueue
+			case <-p.ctx.Done():
+				return errLeftQueue
+			}
+		}
+	}
+
+	for {
+		var res queueResult
+		q.mu.Lock()
+		// Checked under the queue lock so a release cannot slip in between
+		if modem.mu.TryLock() {
+			q.mu.Unlock()
+			res.sess, res.err = p.registerSession(modem, client)
+			if res.err != nil {
+				q.release(p, modem)
+			}
+		} else {
+			w := &waiter{client: client, granted: make(chan queueResult, 1)}
+			q.waiters[modem] = append(q.waiters[modem], w)
+			position := len(q.waiters[modem])
+			q.mu.Unlock()
+
+			log.Println("Client", client, "queued for", modem.Name, "at position", position)
+			notify(position)
+
+			granted := make(chan struct{})
+			go func() {
+				res = <-w.granted
+				close(granted)
+			}()
+			err := wait(granted, func() int { return q.position(modem, w) })
+			if err != nil {
+				// Leave the queue. If the modem was handed over meanwhile, close the session.
+				q.mu.Lock()
+				removed := q.remove(modem, w)
+				q.mu.Unlock()
+				if removed {
+					w.granted <- queueResult{err: err}
+				}
+				<-granted
+				if res.sess != nil {
+					res.sess.close()
+				}
+				return queueResult{err: err}
+			}
+		}
+
+		conflict, ok := res.err.(*conflictError)
+		if !ok {
+			return res
+		}
+
+		// Another modem sharing hardware is in use, try again when its session ends
+		log.Println("Client", client, "waiting for", conflict.resource, "to start", modem.Name)
+		notify(1)
+		err := wait(conflict.holder.closed, func() int { return 1 })
+		if err != nil {
+			return queueResult{err: err}
+		}
+	}
+}
+
+// Returned when a queued client gave up waiting for a modem
+type busyTimeoutError struct {
+	modem   string
+	timeout time.Duration
+}
+
+func (e *busyTimeoutError) Error() string {
+	return "modem " + e.modem + " still busy after " + e.timeout.String()
+}
+
+// Split the argument of "start <name> [wait [timeout]]", the timeout is in seconds.
+// A modem whose name ends in "wait" is started directly.
+func parseStartArgument(modems []*Modem, argument string) (string, bool, time.Duration) {
+	if findModem(modems, argument) != nil {
+		return argument, false, 0
+	}
+	if strings.HasSuffix(argument, " wait") {
+		return strings.TrimSuffix(argument, " wait"), true, 0
+	}
+	i := strings.LastIndex(argument, " wait ")
+	if i < 0 {
+		return argument, false, 0
+	}
+	seconds, err := strconv.Atoi(argument[i+len(" wait "):])
+	if err != nil || seconds < 0 {
+		return argument, false, 0
+	}
+	return argument[:i], true, time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseStartArgument(t *testing.T) {
+	modems := []*Modem{{Name: "IC705FM"}, {Name: "Lets wait"}}
+	cases := []struct {
+		argument string
+		name     string
+		wait     bool
+		timeout  time.Duration
+	}{
+		{"IC705FM", "IC705FM", false, 0},
+		{"IC705FM wait", "IC705FM", true, 0},
+		{"Digirig FM wait 30", "Digirig FM", true, 30 * time.Second},
+		{"IC705FM wait soon", "IC705FM wait soon", false, 0},
+		{"Lets wait", "Lets wait", false, 0},
+		{"Lets wait wait 5", "Lets wait", true, 5 * time.Second},
+	}
+	for _, c := range cases {
+		name, wait, timeout := parseStartArgument(modems, c.argument)
+		if name != c.name || wait != c.wait || timeout != c.timeout {
+			t.Errorf("parseStartArgument(%q) = %q, %v, %v", c.argument, name, wait, timeout)
+		}
+	}
+}
+
+func newQueueTestProgram() *program {
+	p := newTestProgram()
+	p.Modems[0].Cmd = "sleep"
+	p.Modems[0].Args = "10"
+	return p
+}
+
+func TestQueueHandsModemOverInOrder(t *testing.T) {
+	p := newQueueTestProgram()
+	first, firstReader, _ := startTestSession(t, p)
+	send(first, "start IC705FM\n")
+	expectLines(t, first, firstReader, "OK")
+
+	second, secondReader, _ := startTestSession(t, p)
+	send(second, "start IC705FM wait\n")
+	expectLines(t, second, secondReader, "QUEUED position=1")
+
+	third, thirdReader, _ := startTestSession(t, p)
+	send(third, "start ic705fm wait 30\n")
+	expectLines(t, third, thirdReader, "QUEUED position=2")
+
+	// Clients that did not queue cannot jump ahead
+	_, err := p.openSession(p.Modems[0], "test")
+	if errorCode(err, "") != errCodeBusy {
+		t.Fatalf("expected modem to stay busy, got %v", err)
+	}
+
+	send(first, "stop\n")
+	expectLines(t, first, firstReader, "OK")
+	expectLines(t, second, secondReader, "OK")
+
+	send(second, "stop\n")
+	expectLines(t, second, secondReader, "OK")
+	expectLines(t, third, thirdReader, "OK")
+	if s := p.sessions.forModem(p.Modems[0]); s == nil || s.client != "pipe" {
+		t.Fatalf("expected the third client to hold the modem, got %+v", s)
+	}
+}
+
+func TestQueueStartsImmediatelyWhenIdle(t *testing.T) {
+	p := newQueueTestProgram()
+	conn, r, _ := startTestSession(t, p)
+	send(conn, "start IC705FM wait\n")
+	expectLines(t, conn, r, "OK")
+}
+
+func TestQueueTimeout(t *testing.T) {
+	p := newQueueTestProgram()
+	first, firstReader, _ := startTestSession(t, p)
+	send(first, "start IC705FM\n")
+	expectLines(t, first, firstReader, "OK")
+
+	second, secondReader, done := startTestSession(t, p)
+	send(second, "start IC705FM wait 1\n")
+	expectLines(t, second, secondReader, "QUEUED position=1", "ERROR modem IC705FM still busy after 1s")
+	<-done
+}
+
+func TestQueuePeriodicPosition(t *testing.T) {
+	interval := queueNotifyInterval
+	queueNotifyInterval = 50 * time.Millisecond
+	defer func() { queueNotifyInterval = interval }()
+
+	p := newQueueTestProgram()
+	first, firstReader, _ := startTestSession(t, p)
+	send(first, "start IC705FM\n")
+	expectLines(t, first, firstReader, "OK")
+
+	second, secondReader, _ := startTestSession(t, p)
+	send(second, "start IC705FM wait\n")
+	expectLines(t, second, secondReader, "QUEUED position=1", "QUEUED position=1", "QUEUED position=1")
+}
+
+func TestQueueClientLeaves(t *testing.T) {
+	p := newQueueTestProgram()
+	first, firstReader, _ := startTestSession(t, p)
+	send(first, "start IC705FM\n")
+	expectLines(t, first, firstReader, "OK")
+
+	second, secondReader, done := startTestSession(t, p)
+	send(second, "start IC705FM wait\n")
+	expectLines(t, second, secondReader, "QUEUED position=1")
+	second.Close()
+	<-done
+
+	send(first, "stop\n")
+	expectLines(t, first, firstReader, "OK")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s, err := p.openSession(p.Modems[0], "test")
+		if err == nil {
+			s.close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("modem not released after the queued client left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// Error code reported when a reload finds an invalid configuration
+const errCodeInvalidConfig = "invalid_config"
+
+// The current configuration. It is replaced as a whole on reload and never modified
+// in place, so callers can keep using the returned value.
+func (p *program) config() *Config {
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+	return p.Config
+}
+
+// Are two definitions of a modem the same
+func sameModem(a *Modem, b *Modem) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ja, jb)
+}
+
+func sameDisplay(a *Display, b *Display) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Load the configuration file again and apply it without dropping live sessions.
+// Unchanged modems are kept as is, so are their sessions and DNS-SD services. A modem
+// that changed or was removed while in use keeps its current definition until its
+// session ends, the configuration is then reloaded again. The launcher and HTTP ports,
+// TLS, KeepAlive, Display and Delay are only read on startup.
+func (p *program) reload() error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+
+	if p.ctx.Err() != nil {
+		return errors.New("shutting down")
+	}
+
+	log.Println("Reloading configuration")
+	conf, err := getConfig(p.configPath)
+	if err != nil {
+		return fmt.Errorf("%v%s", err, configSyntaxHint(err))
+	}
+	err = validateConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	current := p.config()
+	if conf.Port != current.Port || conf.HttpPort != current.HttpPort || conf.TLS != current.TLS ||
+		*conf.KeepAlive != *current.KeepAlive || !sameDisplay(conf.Display, current.Display) || *conf.Delay != *current.Delay {
+		log.Println("Changes to Port, HttpPort, TLS, KeepAlive, Display and Delay require a restart")
+	}
+	conf.Port = current.Port
+	conf.HttpPort = current.HttpPort
+	conf.TLS = current.TLS
+	conf.KeepAlive = current.KeepAlive
+	conf.Display = current.Display
+	conf.Delay = current.Delay
+
+	var modems []*Modem
+	var deferred []*Modem
+	for _, modem := range conf.Modems {
+		old := findModem(current.Modems, modem.Name)
+		switch {
+		case old == nil:
+			log.Println("Adding modem", modem.Name)
+			modems = append(modems, modem)
+		case sameModem(old, modem):
+			modems = append(modems, old)
+		case old.mu.TryLock():
+			// The old definition stays locked so a client that looked it up
+			// before the swap cannot start it
+			log.Println("Updating modem", modem.Name)
+			modems = append(modems, modem)
+		default:
+			log.Println("Modem", modem.Name, "is in use, deferring its update until the session ends")
+			modems = append(modems, old)
+			deferred = append(deferred, old)
+		}
+	}
+	for _, old := range current.Modems {
+		if findModem(conf.Modems, old.Name) != nil {
+			continue
+		}
+		if old.mu.TryLock() {
+			log.Println("Removing modem", old.Name)
+			continue
+		}
+		log.Println("Modem", old.Name, "is in use, deferring its removal until the session ends")
+		modems = append(modems, old)
+		deferred = append(deferred, old)
+	}
+	conf.Modems = modems
+
+	p.configMu.Lock()
+	p.Config = conf
+	p.configMu.Unlock()
+
+	p.updateAdvertisements(current.Modems, modems)
+
+	p.reloads++
+	for _, modem := range deferred {
+		go p.reloadWhenIdle(modem, p.reloads)
+	}
+	return nil
+}
+
+// Withdraw the services of modems that are gone and advertise the new ones
+func (p *program) updateAdvertisements(previous []*Modem, modems []*Modem) {
+	if p.advertised == nil {
+		return
+	}
+	for _, modem := range previous {
+		if containsModem(modems, modem) {
+			continue
+		}
+		shutdownServers(p.advertised[modem])
+		delete(p.advertised, modem)
+	}
+	for _, modem := range modems {
+		if _, ok := p.advertised[modem]; ok {
+			continue
+		}
+		servers, err := advertiseModem(modem, p.launcherTXT)
+		if err != nil {
+			log.Println("ERROR advertising", modem.Name+":", err)
+			continue
+		}
+		p.advertised[modem] = servers
+	}
+}
+
+func containsModem(modems []*Modem, modem *Modem) bool {
+	for _, m := range modems {
+		if m == modem {
+			return true
+		}
+	}
+	return false
+}
+
+func shutdownServers(servers []*zeroconf.Server) {
+	for _, server := range servers {
+		server.Shutdown()
+	}
+}
+
+// Withdraw every DNS-SD service on shutdown
+func (p *program) withdrawServices() {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	for _, servers := range p.advertised {
+		shutdownServers(servers)
+	}
+	p.advertised = nil
+}
+
+// Reload once the session holding a modem with pending changes ends, unless the
+// configuration was reloaded in the meantime
+func (p *program) reloadWhenIdle(modem *Modem, generation int) {
+	if sess := p.sessions.forModem(modem); sess != nil {
+		select {
+		case <-sess.closed:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+
+	p.reloadMu.Lock()
+	current := p.reloads == generation
+	p.reloadMu.Unlock()
+	if !current {
+		return
+	}
+
+	log.Println("Session on", modem.Name, "ended, applying pending configuration changes")
+	err := p.reload()
+	if err != nil {
+		log.Println("ERROR reloading configuration:", err)
+	}
+}
+
+// Reload the configuration on SIGHUP
+func (p *program) watchReloadSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			err := p.reload()
+			if err != nil {
+				log.Println("ERROR reloading configuration:", err)
+			}
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write a configuration with one modem per "name:args" definition
+func writeTestConfig(t *testing.T, path string, modems ...string) {
+	t.Helper()
+	ini := filepath.Join(filepath.Dir(path), "VARA.ini")
+	writeTestFile(t, ini, "[Setup]\nTCP Command Port=8300\n")
+
+	var defs []string
+	for _, m := range modems {
+		parts := strings.SplitN(m, ":", 2)
+		defs = append(defs, `{"Name": "`+parts[0]+`", "Type": "hf", "Cmd": "echo", "Args": "`+parts[1]+`", "DefaultConfig": "`+filepath.ToSlash(ini)+`"}`)
+	}
+	writeTestFile(t, path, `{"Delay": 0, "Modems": [`+strings.Join(defs, ",")+`]}`)
+}
+
+func newReloadTestProgram(t *testing.T, modems ...string) *program {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "varanny.json")
+	writeTestConfig(t, path, modems...)
+
+	p := newTestProgram()
+	p.configPath = path
+	conf, err := getConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validateConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Config = conf
+	return p
+}
+
+func TestReloadDiffsModems(t *testing.T) {
+	p := newReloadTestProgram(t, "A:a", "B:b", "C:c")
+	a, b := p.Modems[0], p.Modems[1]
+
+	writeTestConfig(t, p.configPath, "A:a", "B:changed", "D:d")
+	err := p.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modems := p.config().Modems
+	if len(modems) != 3 {
+		t.Fatalf("expected 3 modems, got %d", len(modems))
+	}
+	if modems[0] != a {
+		t.Fatal("unchanged modem should be kept")
+	}
+	if modems[1] == b || modems[1].Args != "changed" {
+		t.Fatal("changed modem should be replaced")
+	}
+	if modems[2].Name != "D" || p.findModem("C") != nil {
+		t.Fatal("expected C to be replaced by D")
+	}
+}
+
+func TestReloadDefersBusyModem(t *testing.T) {
+	p := newReloadTestProgram(t, "A:a", "B:b")
+	a := p.Modems[0]
+	sess, err := p.openSession(a, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestConfig(t, p.configPath, "A:changed", "B:b")
+	err = p.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.findModem("A") != a {
+		t.Fatal("modem in use should keep its definition")
+	}
+
+	sess.close()
+	deadline := time.Now().Add(2 * time.Second)
+	for p.findModem("A").Args != "changed" {
+		if time.Now().After(deadline) {
+			t.Fatal("pending change not applied after the session ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadDefersRemovalOfBusyModem(t *testing.T) {
+	p := newReloadTestProgram(t, "A:a", "B:b")
+	sess, err := p.openSession(p.Modems[1], "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestConfig(t, p.configPath, "A:a")
+	err = p.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.findModem("B") == nil {
+		t.Fatal("modem in use should not be removed")
+	}
+
+	sess.close()
+	deadline := time.Now().Add(2 * time.Second)
+	for p.findModem("B") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("modem not removed after the session ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	p := newReloadTestProgram(t, "A:a")
+	conf := p.config()
+
+	writeTestFile(t, p.configPath, `{"Modems": []}`)
+	err := p.reload()
+	if err == nil {
+		t.Fatal("expected reload of an invalid configuration to fail")
+	}
+	if p.config() != conf {
+		t.Fatal("configuration should be unchanged")
+	}
+}
+
+func TestReloadCommand(t *testing.T) {
+	p := newReloadTestProgram(t, "A:a")
+	writeTestConfig(t, p.configPath, "A:a", "B:b")
+
+	conn, r, _ := startTestSession(t, p)
+	send(conn, "reload\nlist\n")
+	expectLines(t, conn, r, "OK", "OK", "A", "B")
+
+	writeTestFile(t, p.configPath, "{")
+	send(conn, "reload\n")
+	expectLines(t, conn, r, "ERROR reload failed: unexpected EOF")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Returned when a modem cannot start because another session holds one of its resources
+type conflictError struct {
+	modem    string
+	resource string
+	holder   *session
+}
+
+func (e *conflictError) Error() string {
+	return "modem " + e.modem + " needs " + e.resource + " held by session " + e.holder.id +
+		" (" + e.holder.modem.Name + " for " + e.holder.client + ")"
+}
+
+// Hardware a modem needs for itself while in use. Modems sharing a radio list the same
+// names, e.g. its serial device, so only one of them runs at a time. The CAT control
+// port and the audio input name, when set, are implied.
+func (m *Modem) resources() []string {
+	resources := append([]string{}, m.Resources...)
+	if m.CatCtrl.Port != 0 {
+		resources = append(resources, "CAT port "+strconv.Itoa(m.CatCtrl.Port))
+	}
+	if m.AudioInputName != "" {
+		resources = append(resources, "audio input "+m.AudioInputName)
+	}
+	return resources
+}
+
+// The resources held by open sessions
+type resourceLocks struct {
+	mu      sync.Mutex
+	holders map[string]*session
+}
+
+func newResourceLocks() *resourceLocks {
+	return &resourceLocks{holders: map[string]*session{}}
+}
+
+// Acquire all the resources of the session modem, or none of them
+func (r *resourceLocks) acquire(s *session) error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	resources := s.modem.resources()
+	for _, resource := range resources {
+		if holder := r.holders[resource]; holder != nil && holder != s {
+			return &conflictError{s.modem.Name, resource, holder}
+		}
+	}
+	for _, resource := range resources {
+		r.holders[resource] = s
+	}
+	return nil
+}
+
+// Release the resources held by a session
+func (r *resourceLocks) release(s *session) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for resource, holder := range r.holders {
+		if holder == s {
+			delete(r.holders, resource)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestModemResources(t *testing.T) {
+	modem := &Modem{
+		Resources:      []string{"/dev/ic-705a"},
+		AudioInputName: "IC-705",
+		CatCtrl:        CatCtrl{Port: 4532},
+	}
+	got := strings.Join(modem.resources(), ",")
+	if got != "/dev/ic-705a,CAT port 4532,audio input IC-705" {
+		t.Fatalf("unexpected resources %q", got)
+	}
+	if len((&Modem{}).resources()) != 0 {
+		t.Fatal("expected no resources")
+	}
+}
+
+func TestResourceLocksAllOrNothing(t *testing.T) {
+	r := newResourceLocks()
+	fm := &session{id: "1", client: "a", modem: &Modem{Name: "FM", Resources: []string{"radio"}}}
+	hf := &session{id: "2", client: "b", modem: &Modem{Name: "HF", Resources: []string{"usb", "radio"}}}
+
+	if err := r.acquire(fm); err != nil {
+		t.Fatal(err)
+	}
+	err := r.acquire(hf)
+	if err == nil || err.Error() != "modem HF needs radio held by session 1 (FM for a)" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if r.holders["usb"] != nil {
+		t.Fatal("resources must not be partially acquired")
+	}
+
+	r.release(fm)
+	if err := r.acquire(hf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newSharedRadioTestProgram() *program {
+	p := newTestProgram()
+	for _, modem := range p.Modems {
+		modem.Cmd = "sleep"
+		modem.Args = "10"
+		modem.CatCtrl.Port = 4532
+	}
+	return p
+}
+
+func TestSharedResourceConflict(t *testing.T) {
+	p := newSharedRadioTestProgram()
+	fm, fmReader, _ := startTestSession(t, p)
+	send(fm, "start IC705FM\n")
+	expectLines(t, fm, fmReader, "OK")
+
+	hf, hfReader, done := startTestSession(t, p)
+	send(hf, "start IC705HF\n")
+	expectLines(t, hf, hfReader, "ERROR modem IC705HF needs CAT port 4532 held by session 1 (IC705FM for pipe)")
+	<-done
+
+	// The failed start must leave the modem free
+	if !p.Modems[1].mu.TryLock() {
+		t.Fatal("IC705HF still locked after conflict")
+	}
+	p.Modems[1].mu.Unlock()
+}
+
+func TestQueueWaitsForSharedResource(t *testing.T) {
+	p := newSharedRadioTestProgram()
+	fm, fmReader, _ := startTestSession(t, p)
+	send(fm, "start IC705FM\n")
+	expectLines(t, fm, fmReader, "OK")
+
+	hf, hfReader, _ := startTestSession(t, p)
+	send(hf, "start IC705HF wait\n")
+	expectLines(t, hf, hfReader, "QUEUED position=1")
+
+	send(fm, "stop\n")
+	expectLines(t, fm, fmReader, "OK")
+	expectLines(t, hf, hfReader, "OK")
+	if p.sessions.forModem(p.Modems[1]) == nil {
+		t.Fatal("expected IC705HF to be started")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+// Actions accepted by the -service command line option
+var serviceActions = []string{"install", "uninstall", "start", "stop", "restart", "status"}
+
+// Describe how varanny is registered with the OS service manager. The absolute
+// config path is baked into the service arguments so the service does not depend
+// on the working directory it is started from.
+func newServiceConfig(configPath string) *service.Config {
+	svcConfig := &service.Config{
+		Name:        "varanny",
+		DisplayName: "varanny",
+		Description: "Launcher and DNS-SD advertiser for VARA modems",
+		Arguments:   []string{"-config", configPath},
+	}
+	if runtime.GOOS == "linux" {
+		svcConfig.Dependencies = []string{
+			"Wants=network-online.target",
+			"After=network-online.target sound.target",
+		}
+	}
+	return svcConfig
+}
+
+// Start is called by the service manager, or by Run when executing interactively.
+// It must return quickly, so the actual work is done in a separate goroutine.
+func (p *program) Start(s service.Service) error {
+	log.Println("Starting varanny", version)
+	go func() {
+		defer close(p.done)
+
+		if *p.Delay > 0 {
+			log.Println("  Delaying startup for", *p.Delay, "seconds")
+			log.Println("  (if this is unwanted, set Delay to 0 in the config file)")
+			select {
+			case <-time.After(time.Duration(*p.Delay) * time.Second):
+			case <-p.ctx.Done():
+				return
+			}
+		}
+
+		p.run()
+	}()
+	return nil
+}
+
+// Stop cancels the program context and waits for the launcher to release its
+// sessions so that modem processes are terminated and .ini files restored
+// before the process exits.
+func (p *program) Stop(s service.Service) error {
+	log.Println("Shutting down...")
+	p.cancel()
+	<-p.done
+	return nil
+}
+
+// Run one of the service management actions against the OS service manager
+func controlService(s service.Service, action string) error {
+	if action == "status" {
+		status, err := s.Status()
+		if err != nil {
+			return err
+		}
+		switch status {
+		case service.StatusRunning:
+			fmt.Println("varanny service is running")
+		case service.StatusStopped:
+			fmt.Println("varanny service is stopped")
+		default:
+			fmt.Println("varanny service status is unknown")
+		}
+		return nil
+	}
+
+	for _, a := range serviceActions {
+		if a == action {
+			return service.Control(s, action)
+		}
+	}
+	return fmt.Errorf("unknown service action %q, valid actions are %v", action, serviceActions)
+}
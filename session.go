@@ -0,0 +1,677 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Events pushed asynchronously to the client when a supervised process exits
+const (
+	eventModemExited = "modem-exited"
+	eventCatExited   = "cat-exited"
+)
+
+// Reported when a supervised process exits while the session is open
+type sessionEvent struct {
+	Name     string
+	ExitCode int
+}
+
+// Returned when a modem is already held by another session
+type busyError struct {
+	modem string
+}
+
+func (e *busyError) Error() string {
+	return "modem " + e.modem + " is already running"
+}
+
+// A session holds the processes started for a modem on behalf of a client
+// and knows how to tear them down and restore the VARA configuration.
+type session struct {
+	id          string
+	client      string
+	started     time.Time
+	lastActive  time.Time // last command received from the client, guarded by mu
+	monitor     bool      // only monitoring audio levels, no processes, guarded by mu
+	detached    bool      // started over HTTP rather than by a connected client, guarded by mu
+	modem       *Modem
+	modemCmd    *exec.Cmd
+	catCtrlCmd  *exec.Cmd
+	configPath  string // .ini file to restore when the session ends
+	journal     *journal
+	display     *displayServer // virtual X display for the modem, if configured
+	hasDisplay  bool           // the display was acquired and must be released
+	hooked      bool           // a PreStart hook succeeded or there is none, the stop hooks must run as well
+	startFailed bool           // start returned an error, told to the stop hooks
+
+	// Closed by the supervisor when the corresponding process exits
+	modemDone   chan struct{}
+	catCtrlDone chan struct{}
+
+	// Asynchronous events for the client
+	events chan sessionEvent
+
+	mu        sync.Mutex
+	closing   bool
+	starting  sync.WaitGroup // a start in progress, close waits for it
+	stopping  chan struct{}  // closed when the session starts closing, aborts a start in progress
+	closeOnce sync.Once
+	closed    chan struct{} // closed once the session has been torn down
+	release   func()        // unlocks the modem and unregisters the session
+}
+
+func newSession(modem *Modem, journal *journal) *session {
+	now := time.Now()
+	return &session{
+		modem:      modem,
+		journal:    journal,
+		started:    now,
+		lastActive: now,
+		events:     make(chan sessionEvent, 2),
+		stopping:   make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+}
+
+// Lock the modem and register a new session for it. The modem is unlocked when
+// the session is closed.
+func (p *program) openSession(modem *Modem, client string) (*session, error) {
+	if modem.mu.TryLock() == false {
+		return nil, &busyError{modem.Name}
+	}
+	s, err := p.registerSession(modem, client)
+	if err != nil {
+		p.queues.release(p, modem)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Acquire the resources of a modem locked by the caller and register a new session for
+// it. When the session is closed the modem goes to the next queued client or is
+// unlocked.
+func (p *program) registerSession(modem *Modem, client string) (*session, error) {
+	s := newSession(modem, p.journal)
+	s.client = client
+	s.display = p.display
+	err := p.resources.acquire(s)
+	if err != nil {
+		return nil, err
+	}
+	s.release = func() {
+		p.resources.release(s)
+		p.queues.release(p, modem)
+		p.sessions.remove(s)
+	}
+	p.sessions.add(s)
+	return s, nil
+}
+
+// Returned by start when the session was closed before the modem was up
+var errSessionClosed = errors.New("session closed while starting")
+
+// Start cat control and the modem, swapping the .ini file if needed. If the session is
+// closed meanwhile nothing else is launched and close tears down what was.
+func (s *session) start() (err error) {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return errSessionClosed
+	}
+	s.starting.Add(1)
+	s.mu.Unlock()
+	defer s.starting.Done()
+	defer func() {
+		s.mu.Lock()
+		s.startFailed = err != nil
+		s.mu.Unlock()
+	}()
+
+	err = s.runHooks(hookPreStart, s.modem.PreStart)
+	if err != nil {
+		return err
+	}
+	s.setHooked()
+	err = s.startProcesses()
+	if err != nil {
+		return err
+	}
+	s.runHooks(hookPostStart, s.modem.PostStart)
+	return nil
+}
+
+func (s *session) startProcesses() error {
+	modem := s.modem
+
+	// Start cat control if defined first. No need to start VARA if cat control fails
+	if modem.CatCtrl.Cmd != "" {
+		logWriter := log.Writer()
+		multiWriter := io.MultiWriter(logWriter)
+		args, err := modem.CatCtrl.Args.split()
+		if err != nil {
+			return fmt.Errorf("invalid CatCtrl Args: %v", err)
+		}
+		catCtrlCmd := createCommand(multiWriter, modem.CatCtrl.Cmd, args...)
+		if catCtrlCmd == nil {
+			return fmt.Errorf("cannot find cat control executable %s", modem.CatCtrl.Cmd)
+		}
+
+		if s.aborted() {
+			return errSessionClosed
+		}
+		modem.CatCtrl.ProcessEnv.apply(catCtrlCmd)
+		log.Println("Starting cat control for", modem.Name)
+		log.Println("Command:", catCtrlCmd.Path, catCtrlCmd.Args)
+		err = catCtrlCmd.Start()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.catCtrlCmd = catCtrlCmd
+		s.catCtrlDone = s.supervise(catCtrlCmd, eventCatExited)
+		s.mu.Unlock()
+	}
+
+	if modem.Cmd == "" {
+		return nil
+	}
+
+	logWriter := log.Writer()
+	multiWriter := io.MultiWriter(logWriter)
+	args, err := modem.Args.split()
+	if err != nil {
+		return fmt.Errorf("invalid Args: %v", err)
+	}
+	modemCmd := createCommand(multiWriter, modem.Cmd, args...)
+	if modemCmd == nil {
+		return fmt.Errorf("cannot find modem executable %s", modem.Cmd)
+	}
+
+	if s.aborted() {
+		return errSessionClosed
+	}
+	err = s.installConfig()
+	if err != nil {
+		return err
+	}
+
+	display, err := s.display.acquire()
+	if err != nil {
+		return err
+	}
+	if display != "" {
+		s.mu.Lock()
+		s.hasDisplay = true
+		s.mu.Unlock()
+		modemCmd.Env = append(modemCmd.Env, "DISPLAY="+display)
+	}
+	modem.ProcessEnv.apply(modemCmd)
+
+	if s.aborted() {
+		return errSessionClosed
+	}
+	log.Println("Starting modem for", modem.Name)
+	log.Println("Command:", modemCmd.Path, modemCmd.Args)
+	err = modemCmd.Start()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.modemCmd = modemCmd
+	s.modemDone = s.supervise(modemCmd, eventModemExited)
+	modemDone := s.modemDone
+	s.mu.Unlock()
+
+	return s.waitForPort(modemDone)
+}
+
+// Whether the session started closing, a start in progress must not launch anything else
+func (s *session) aborted() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Swap the config file to the one defined in the modem if needed
+func (s *session) installConfig() error {
+	modem := s.modem
+	if modem.Config == "" {
+		return nil
+	}
+
+	var varaDefaultConfigFile = modem.DefaultConfig
+	configPath, err := defaultIniConfigPath(modem, varaDefaultConfigFile)
+	if err != nil {
+		return err
+	}
+	modemConfigPath := modem.Config
+
+	if modemConfigPath == configPath {
+		return nil
+	}
+
+	// Check if requested modem config exists
+	if !FileExists(modemConfigPath) {
+		log.Println("Modem config file", modemConfigPath, "does not exist")
+		return nil
+	}
+
+	// Record the swap before touching anything so it can be undone after a crash
+	backupPath := configPath + ".varanny.bak"
+	err = s.journal.add(journalEntry{Config: configPath, Backup: backupPath})
+	if err != nil {
+		return err
+	}
+
+	// Make backup
+	log.Println("Backing up current config file", configPath)
+	err = CopyFile(configPath, backupPath)
+	if err == nil {
+		err = VerifyFileCopy(configPath, backupPath)
+	}
+	if err != nil {
+		s.journal.remove(configPath)
+		os.Remove(backupPath)
+		return fmt.Errorf("cannot back up config file %s: %v", configPath, err)
+	}
+
+	// Without the mark a crash would leave the profile installed for good
+	err = s.journal.markInstalled(configPath)
+	if err != nil {
+		s.journal.remove(configPath)
+		os.Remove(backupPath)
+		return fmt.Errorf("cannot record config file %s in journal: %v", configPath, err)
+	}
+	s.mu.Lock()
+	s.configPath = configPath
+	s.mu.Unlock()
+
+	// VARA must not start with a partially installed or altered profile
+	log.Println("Installing modem config file", modemConfigPath)
+	err = CopyFile(modemConfigPath, configPath)
+	if err == nil {
+		err = VerifyFileCopy(modemConfigPath, configPath)
+	}
+	if err != nil {
+		return fmt.Errorf("config file verification failed for %s: %v", configPath, err)
+	}
+	return nil
+}
+
+// Interval between two checks of the VARA ports while it starts
+var portPollInterval = time.Second
+
+// Defaults for Modem.StartTimeout and Modem.StopTimeout
+const (
+	defaultStartTimeout = 10 * time.Second
+	defaultStopTimeout  = 5 * time.Second
+)
+
+func (m *Modem) startTimeout() time.Duration {
+	if m.StartTimeout > 0 {
+		return time.Duration(m.StartTimeout) * time.Second
+	}
+	return defaultStartTimeout
+}
+
+func (m *Modem) stopTimeout() time.Duration {
+	if m.StopTimeout > 0 {
+		return time.Duration(m.StopTimeout) * time.Second
+	}
+	return defaultStopTimeout
+}
+
+// Wait until VARA has bound its command port and its data port, the next one. Fails
+// if it takes longer than the start timeout of the modem, if VARA exits first, if the
+// session is closed meanwhile or if the ports cannot be checked until the timeout.
+func (s *session) waitForPort(exited chan struct{}) error {
+	modem := s.modem
+	if modem.Port == 0 {
+		return nil
+	}
+	timeout := modem.startTimeout()
+	deadline := time.Now().Add(timeout)
+	for {
+		// Check the OS to see if port is in use. Do not try to connect as VARA won't be able to rebind if
+		// we connect and close
+		port, err := firstPort(false, modem.Port, modem.Port+1)
+		if err == nil && port == 0 {
+			return nil
+		}
+		if err != nil {
+			log.Println("Cannot check the ports of", modem.Name, ":", err)
+			port = modem.Port
+		}
+
+		select {
+		case <-exited:
+			return fmt.Errorf("modem exited before binding port %d", port)
+		default:
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("cannot check whether modem bound port %d: %v", port, err)
+			}
+			return fmt.Errorf("modem did not bind port %d within %v", port, timeout)
+		}
+		select {
+		case <-s.stopping:
+			return errSessionClosed
+		case <-time.After(portPollInterval):
+		}
+	}
+}
+
+// Return the first of the ports something listens on, or nothing when bound is false.
+// 0 if there is none.
+func firstPort(bound bool, ports ...int) (int, error) {
+	for _, port := range ports {
+		found, err := isPortInUse(port)
+		if err != nil {
+			return 0, err
+		}
+		if found == bound {
+			return port, nil
+		}
+	}
+	return 0, nil
+}
+
+// Wait until nothing listens on the VARA ports anymore so the next session can bind
+// them. Gives up after timeout.
+func (s *session) waitForPortRelease(timeout time.Duration) {
+	modem := s.modem
+	if modem.Port == 0 {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		port, err := firstPort(true, modem.Port, modem.Port+1)
+		if err != nil || port == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Println("WARNING port", port, "still in use after stopping", modem.Name)
+			return
+		}
+		time.Sleep(portPollInterval)
+	}
+}
+
+// Stop the wineserver of the modem prefix. It outlives VARA and may hold on to its ports.
+func (s *session) killWineserver(timeout time.Duration) {
+	cmd := createCommand(log.Writer(), "wineserver", "-k")
+	if cmd == nil {
+		return
+	}
+	s.modem.ProcessEnv.apply(cmd)
+
+	log.Println("Stopping wineserver for", s.modem.Name)
+	err := cmd.Start()
+	if err != nil {
+		log.Println("ERROR stopping wineserver:", err)
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cmd.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Println("wineserver -k still running after", timeout, ", killing")
+		signalProcessGroup(cmd, syscall.SIGKILL)
+		<-done
+	}
+}
+
+// Wait for the process in the background. If it exits while the session is still
+// open, an event line is queued for the client. The returned channel is closed
+// once the process has been reaped.
+func (s *session) supervise(cmd *exec.Cmd, event string) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Use Process.Wait rather than cmd.Wait, children inheriting the output
+		// pipes (e.g. wineserver) would otherwise keep us waiting
+		processState, err := cmd.Process.Wait()
+		if err != nil {
+			log.Println("Warning: awaiting termination of", cmd.Path, "failed:", err)
+			return
+		}
+
+		s.mu.Lock()
+		closing := s.closing
+		s.mu.Unlock()
+		if closing {
+			return
+		}
+
+		log.Println("Process", cmd.Path, "for", s.modem.Name, "exited unexpectedly with code", processState.ExitCode())
+		select {
+		case s.events <- sessionEvent{event, processState.ExitCode()}:
+		default:
+		}
+	}()
+	return done
+}
+
+// Terminate the processes and restore the original config file. Safe to call more than once.
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closing = true
+		s.mu.Unlock()
+
+		// Let a start in progress give up, then tear down whatever it launched
+		close(s.stopping)
+		s.starting.Wait()
+
+		s.mu.Lock()
+		modemCmd, modemDone := s.modemCmd, s.modemDone
+		catCtrlCmd, catCtrlDone := s.catCtrlCmd, s.catCtrlDone
+		configPath := s.configPath
+		hasDisplay := s.hasDisplay
+		hooked := s.hooked
+		s.mu.Unlock()
+
+		if hooked {
+			s.runHooks(hookPreStop, s.modem.PreStop)
+		}
+
+		grace := s.modem.stopTimeout()
+		if modemCmd != nil {
+			terminateProcess(modemCmd, modemDone, "modem", grace)
+			if s.modem.KillWineserver {
+				s.killWineserver(grace)
+			}
+			s.waitForPortRelease(grace)
+		}
+
+		if hasDisplay {
+			s.display.release()
+		}
+
+		if configPath != "" {
+			log.Println("Restoring original config file", configPath)
+			err := RestoreFile(configPath+".varanny.bak", configPath)
+			if err != nil {
+				log.Println("ERROR restoring", configPath, ":", err)
+			} else {
+				s.journal.remove(configPath)
+			}
+		}
+
+		if catCtrlCmd != nil {
+			terminateProcess(catCtrlCmd, catCtrlDone, "cat control", grace)
+		}
+
+		if hooked {
+			s.runHooks(hookPostStop, s.modem.PostStop)
+		}
+
+		if s.release != nil {
+			s.release()
+		}
+		close(s.closed)
+	})
+}
+
+// Record activity from the client holding the session
+func (s *session) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActive = time.Now()
+}
+
+func (s *session) isMonitor() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.monitor
+}
+
+// Whether the session was started over HTTP, any holder of the secret may stop it
+func (s *session) isDetached() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.detached
+}
+
+func (s *session) lastActivity() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastActive
+}
+
+// State of the modem and cat control processes, see processStatus
+func (s *session) processStatus() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return processStatus(s.modemCmd, s.modemDone), processStatus(s.catCtrlCmd, s.catCtrlDone)
+}
+
+// Describe the state of a supervised process
+func processStatus(cmd *exec.Cmd, done chan struct{}) string {
+	if cmd == nil || done == nil {
+		return "none"
+	}
+	select {
+	case <-done:
+		return "exited"
+	default:
+		return "running"
+	}
+}
+
+// Ask a supervised process and the rest of its process group to exit, kill them if
+// they are still running after the grace period, and wait until the process has been
+// reaped. Children can outlive the process itself, wine returns early for instance.
+func terminateProcess(cmd *exec.Cmd, done chan struct{}, name string, grace time.Duration) {
+	exited := func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
+	if exited() {
+		if !processGroupAlive(cmd) {
+			return
+		}
+		log.Println("Shutdown processes left by", name, "process")
+	} else {
+		log.Println("Shutdown", name, "process gracefully")
+	}
+
+	// Gracefully shutdown processes on linux and kill on windows
+	err := signalProcessGroup(cmd, syscall.SIGTERM)
+	if err != nil {
+		log.Println("Shutdown", name, "process gracefully failed, killing")
+		signalProcessGroup(cmd, syscall.SIGKILL)
+	}
+
+	deadline := time.Now().Add(grace)
+	for !exited() || processGroupAlive(cmd) {
+		if time.Now().After(deadline) {
+			log.Println(name, "processes still running after", grace, ", killing")
+			signalProcessGroup(cmd, syscall.SIGKILL)
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	<-done
+}
+
+// Keeps track of the open sessions so they can be listed and stopped by id
+type sessionRegistry struct {
+	mu       sync.Mutex
+	lastID   int
+	sessions map[string]*session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: map[string]*session{}}
+}
+
+func (r *sessionRegistry) add(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastID++
+	s.id = strconv.Itoa(r.lastID)
+	r.sessions[s.id] = s
+}
+
+func (r *sessionRegistry) remove(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, s.id)
+}
+
+func (r *sessionRegistry) get(id string) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+// Return the session holding the modem, if any
+func (r *sessionRegistry) forModem(modem *Modem) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sessions {
+		if s.modem == modem {
+			return s
+		}
+	}
+	return nil
+}
+
+// Return the open sessions, oldest first
+func (r *sessionRegistry) list() []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		a, _ := strconv.Atoi(sessions[i].id)
+		b, _ := strconv.Atoi(sessions[j].id)
+		return a < b
+	})
+	return sessions
+}
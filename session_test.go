@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Return a port nothing listens on
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func newStartTimeoutTestProgram(t *testing.T) (*program, string) {
+	saved := portPollInterval
+	portPollInterval = 50 * time.Millisecond
+	t.Cleanup(func() { portPollInterval = saved })
+
+	dir := t.TempDir()
+	ini := filepath.Join(dir, "VARA.ini")
+	writeTestFile(t, ini, "original")
+	writeTestFile(t, filepath.Join(dir, "fm.ini"), "fm")
+
+	p := newTestProgram()
+	p.journal = newJournal(filepath.Join(dir, "journal.json"))
+	modem := p.Modems[0]
+	modem.Cmd = "sleep"
+	modem.Args = "10"
+	modem.Config = filepath.Join(dir, "fm.ini")
+	modem.DefaultConfig = ini
+	modem.StartTimeout = 1
+	return p, ini
+}
+
+func TestStartTimeout(t *testing.T) {
+	p, ini := newStartTimeoutTestProgram(t)
+	modem := p.Modems[0]
+	modem.Port = freePort(t)
+
+	conn, r, done := startTestSession(t, p)
+	send(conn, "start IC705FM\n")
+	expectLines(t, conn, r, "ERROR modem did not bind port "+strconv.Itoa(modem.Port)+" within 1s")
+	<-done
+
+	if p.sessions.forModem(modem) != nil {
+		t.Fatal("expected the session to be closed")
+	}
+	expectFileContent(t, ini, "original")
+}
+
+func TestStartWaitsForDataPort(t *testing.T) {
+	p, _ := newStartTimeoutTestProgram(t)
+	modem := p.Modems[0]
+
+	// Only the command port is bound
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	modem.Port = ln.Addr().(*net.TCPAddr).Port
+
+	sess, err := p.openSession(modem, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	err = sess.start()
+	if err == nil || !strings.Contains(err.Error(), "port "+strconv.Itoa(modem.Port+1)) {
+		t.Fatalf("expected the data port to be missing, got %v", err)
+	}
+	// Closing the session waits for the port to be released
+	ln.Close()
+}
+
+func TestStartFailsWhenModemExits(t *testing.T) {
+	p, _ := newStartTimeoutTestProgram(t)
+	modem := p.Modems[0]
+	modem.Cmd = "false"
+	modem.Args = ""
+	modem.Port = freePort(t)
+	modem.StartTimeout = 5
+
+	sess, err := p.openSession(modem, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	started := time.Now()
+	err = sess.start()
+	if err == nil || err.Error() != "modem exited before binding port "+strconv.Itoa(modem.Port) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if time.Since(started) > 2*time.Second {
+		t.Fatal("expected the start to fail as soon as the modem exited")
+	}
+}
+
+func TestCloseDuringPreStartHook(t *testing.T) {
+	p, ini := newStartTimeoutTestProgram(t)
+	dir := t.TempDir()
+	ready := filepath.Join(dir, "ready")
+	launched := filepath.Join(dir, "launched")
+	modem := p.Modems[0]
+	modem.Cmd = "touch"
+	modem.Args = CommandArgs(quoteArgs([]string{launched}))
+	hook := CommandArgs(quoteArgs([]string{"sh", "-c", `touch "` + ready + `"; sleep 10`}))
+	modem.PreStart = []CommandArgs{hook}
+
+	conn, r, done := startTestSession(t, p)
+	send(conn, "start IC705FM\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for !FileExists(ready) {
+		if time.Now().After(deadline) {
+			t.Fatal("PreStart hook did not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Killed by an administrator while the hook sleeps
+	started := time.Now()
+	p.sessions.forModem(modem).close()
+	if time.Since(started) > 2*time.Second {
+		t.Fatal("expected closing to abort the PreStart hook")
+	}
+	expectLines(t, conn, r, "ERROR hook PreStart '"+string(hook)+"' failed: session closed while starting")
+	<-done
+
+	if FileExists(launched) {
+		t.Fatal("expected the modem not to be started once the session was closed")
+	}
+	expectFileContent(t, ini, "original")
+	if p.sessions.forModem(modem) != nil {
+		t.Fatal("expected the session to be closed")
+	}
+	if !modem.mu.TryLock() {
+		t.Fatal("expected the modem to be unlocked")
+	}
+	modem.mu.Unlock()
+}
+
+func TestStartFailsWhenExecutableMissing(t *testing.T) {
+	p := newTestProgram()
+	modem := p.Modems[0]
+	modem.Cmd = "varanny-no-such-modem"
+
+	conn, r, done := startTestSession(t, p)
+	send(conn, "start IC705FM\n")
+	expectLines(t, conn, r, "ERROR cannot find modem executable varanny-no-such-modem")
+	<-done
+
+	modem.Cmd = "echo"
+	modem.CatCtrl.Cmd = "varanny-no-such-rigctld"
+	conn, r, done = startTestSession(t, p)
+	send(conn, "start IC705FM\n")
+	expectLines(t, conn, r, "ERROR cannot find cat control executable varanny-no-such-rigctld")
+	<-done
+}
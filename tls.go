@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// Validity of the generated self-signed certificate
+const selfSignedValidity = 20 * 365 * 24 * time.Hour
+
+// Paths of the self-signed certificate generated next to the configuration file,
+// e.g. varanny.json -> varanny.crt and varanny.key
+func selfSignedPaths(configPath string) (string, string) {
+	base := strings.TrimSuffix(configPath, ".json")
+	return base + ".crt", base + ".key"
+}
+
+// Load the TLS certificate, generating and saving a self-signed one if the files do
+// not exist yet so clients can keep pinning the same fingerprint across restarts.
+func loadOrCreateCertificate(certFile string, keyFile string) (tls.Certificate, error) {
+	if !FileExists(certFile) && !FileExists(keyFile) {
+		log.Println("Generating self-signed certificate", certFile)
+		err := createSelfSignedCertificate(certFile, keyFile)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+func createSelfSignedCertificate(certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "varanny"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if hostname != "" {
+		template.DNSNames = []string{hostname, hostname + ".local"}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// Hex encoded SHA-256 of the leaf certificate, advertised for pinning
+func certificateFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
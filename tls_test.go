@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelfSignedPaths(t *testing.T) {
+	certFile, keyFile := selfSignedPaths(filepath.Join("etc", "varanny.json"))
+	if certFile != filepath.Join("etc", "varanny.crt") || keyFile != filepath.Join("etc", "varanny.key") {
+		t.Fatalf("unexpected paths %q %q", certFile, keyFile)
+	}
+}
+
+func TestSelfSignedCertificatePersists(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := selfSignedPaths(filepath.Join(dir, "varanny.json"))
+
+	cert, err := loadOrCreateCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !FileExists(certFile) || !FileExists(keyFile) {
+		t.Fatal("certificate not saved")
+	}
+
+	reloaded, err := loadOrCreateCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := certificateFingerprint(cert)
+	if len(fingerprint) != 64 || fingerprint != certificateFingerprint(reloaded) {
+		t.Fatalf("fingerprint changed across restarts: %q %q", fingerprint, certificateFingerprint(reloaded))
+	}
+}
+
+func TestLauncherOptions(t *testing.T) {
+	p := newTestProgram()
+	p.Port = 8273
+	if got := strings.Join(p.launcherOptions(), ""); got != "launchport=8273;" {
+		t.Fatalf("unexpected options %q", got)
+	}
+
+	p.configPath = filepath.Join(t.TempDir(), "varanny.json")
+	p.Port = 0
+	p.TLS.Port = 8274
+	err := p.loadTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "tlsport=8274;tlsfingerprint=" + certificateFingerprint(p.tlsConfig.Certificates[0]) + ";"
+	if got := strings.Join(p.launcherOptions(), ""); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestTLSConnectionPinned(t *testing.T) {
+	p := newTestProgram()
+	p.configPath = filepath.Join(t.TempDir(), "varanny.json")
+	p.TLS.Port = 1
+	err := p.loadTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := certificateFingerprint(p.tlsConfig.Certificates[0])
+
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(tls.Server(server, p.tlsConfig), p)
+		close(done)
+	}()
+
+	// Clients pin the advertised fingerprint instead of trusting a CA
+	conn := tls.Client(client, &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			sum := sha256.Sum256(rawCerts[0])
+			if hex.EncodeToString(sum[:]) != fingerprint {
+				return errors.New("fingerprint mismatch")
+			}
+			return nil
+		},
+	})
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Write([]byte("version\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	for _, want := range []string{"OK", version} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSuffix(line, "\n"); got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+}
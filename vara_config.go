@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
@@ -62,7 +64,9 @@ func FileExists(filename string) bool {
 	return false
 }
 
-// Copy the file from the source to the destination
+// Copy the file from the source to the destination. The content goes to a temporary
+// file next to the destination which is flushed and renamed over it, so the destination
+// is never left partially written.
 func CopyFile(source string, destination string) error {
 	// Open the source file
 	src, err := os.Open(source)
@@ -71,17 +75,108 @@ func CopyFile(source string, destination string) error {
 	}
 	defer src.Close()
 
-	// Create the destination file
-	dst, err := os.Create(destination)
+	// Keep the permissions of the file being replaced
+	info, err := os.Stat(destination)
+	if err != nil {
+		info, err = src.Stat()
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeAtomic(destination, info.Mode().Perm(), func(dst io.Writer) error {
+		// Copy the bytes from source to destination
+		_, err := io.Copy(dst, src)
+		return err
+	})
+}
+
+// Write data to a temporary file in the destination directory, flush it to disk
+// and rename it over the destination so readers never see a partial file
+func WriteFileAtomic(path string, data []byte) error {
+	return writeAtomic(path, 0644, func(dst io.Writer) error {
+		_, err := dst.Write(data)
+		return err
+	})
+}
+
+func writeAtomic(path string, perm os.FileMode, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
 
-	// Copy the bytes from source to destination
-	_, err = io.Copy(dst, src)
+	err = os.Rename(tmp.Name(), path)
 	if err != nil {
 		return err
 	}
-	return err
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// Move the backup over the original file
+func RestoreFile(backup string, original string) error {
+	err := os.Rename(backup, original)
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(original))
+	return nil
+}
+
+// Flush a directory entry to disk after a rename. Best effort, not supported on all platforms.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// Return the hex encoded SHA-256 of the file content
+func FileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Check that two files have identical content
+func VerifyFileCopy(source string, destination string) error {
+	want, err := FileChecksum(source)
+	if err != nil {
+		return err
+	}
+	got, err := FileChecksum(destination)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("checksum of %s does not match %s", destination, source)
+	}
+	return nil
 }
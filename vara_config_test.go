@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -46,3 +47,58 @@ func TestDefaultVaraConfigFileUnknownExe(t *testing.T) {
 	}
 }
 
+func TestCopyFileReplacesAtomically(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "VARA.digirig.ini")
+	dst := filepath.Join(dir, "VARA.ini")
+	if err := os.WriteFile(src, []byte("[Setup]\nTCP Command Port=8300\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, []byte("a much longer original content that must not survive"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CopyFile(src, dst); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := VerifyFileCopy(src, dst); err != nil {
+		t.Fatalf("expected identical files: %v", err)
+	}
+
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Fatalf("expected destination permissions to be kept, got %v", info.Mode().Perm())
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Fatalf("expected no temporary file left behind, got %d entries", len(entries))
+	}
+}
+
+func TestVerifyFileCopyMismatch(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.ini")
+	b := filepath.Join(dir, "b.ini")
+	os.WriteFile(a, []byte("a"), 0644)
+	os.WriteFile(b, []byte("b"), 0644)
+	if err := VerifyFileCopy(a, b); err == nil {
+		t.Fatal("expected checksum mismatch")
+	}
+}
+
+func TestFileChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.ini")
+	os.WriteFile(path, nil, 0644)
+	got, err := FileChecksum(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
@@ -14,6 +14,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -22,16 +23,15 @@ import (
 	"net"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/cakturk/go-netstat/netstat"
 	"github.com/grandcat/zeroconf"
+	"github.com/kardianos/service"
 )
 
 // This gets set at build time derived from the git tag
@@ -39,31 +39,83 @@ import (
 var version = "undefined"
 
 type Config struct {
-	AudioInputNameThreshold float64 `json:"AudioInputNameThreshold"`
-	Delay                   *int    `json:"Delay"` // allow 0 value, defaults to 10
-	Modems                  []Modem `json:"Modems"`
-	Port                    int     `json:"Port"`
+	AllowedNetworks         []string `json:"AllowedNetworks"` // CIDR networks clients may connect from
+	DeniedNetworks          []string `json:"DeniedNetworks"`
+	AudioInputNameThreshold float64  `json:"AudioInputNameThreshold"`
+	Delay                   *int     `json:"Delay"` // allow 0 value, defaults to 10
+	EndSessionOnExit        bool     `json:"EndSessionOnExit"`
+	HttpPort                int      `json:"HttpPort"`    // optional HTTP management API
+	IdleTimeout             int      `json:"IdleTimeout"` // seconds without commands before a connection is closed, 0 disables
+	KeepAlive               *int     `json:"KeepAlive"`   // TCP keepalive period in seconds, allow 0 to disable, defaults to 30
+	Secret                  string   `json:"Secret"`      // optional shared secret required to control modems
+	AdminSecret             string   `json:"AdminSecret"` // optional secret required to manage other sessions
+	Modems                  []*Modem `json:"Modems"`
+	Port                    int      `json:"Port"`
+	TLS                     TLS      `json:"TLS,omitempty"`     // optional TLS listener
+	Display                 *Display `json:"Display,omitempty"` // optional virtual X display for Wine
+	access                  *accessList
 }
 type Modem struct {
-	Name           string  `json:"Name"`
-	Type           string  `json:"Type"`
-	Cmd            string  `json:"Cmd"`
-	Args           string  `json:"Args"`
-	Config         string  `json:"Config"`
-	DefaultConfig string `json:"DefaultConfig"`
-	AudioInputName string  `json:"AudioInputName"`
-	CatCtrl        CatCtrl `json:"CatCtrl,omitempty"`
-	mu             sync.Mutex
-	Port           int
+	Name           string      `json:"Name"`
+	Type           string      `json:"Type"`
+	Cmd            string      `json:"Cmd"`
+	Args           CommandArgs `json:"Args"`
+	Config         string      `json:"Config"`
+	DefaultConfig  string      `json:"DefaultConfig"`
+	AudioInputName string      `json:"AudioInputName"`
+	// Hardware shared with other modems, only one modem using it runs at a time
+	Resources []string `json:"Resources"`
+	CatCtrl   CatCtrl  `json:"CatCtrl,omitempty"`
+	// Networks the modem can be started from, on top of the global lists
+	AllowedNetworks []string `json:"AllowedNetworks"`
+	DeniedNetworks  []string `json:"DeniedNetworks"`
+	// Seconds VARA has to bind its ports before the start fails, defaults to 10
+	StartTimeout int `json:"StartTimeout"`
+	// Seconds the processes have to exit when the session ends before they are
+	// killed, defaults to 5
+	StopTimeout int `json:"StopTimeout"`
+	// Run "wineserver -k" in the prefix of the modem when the session ends
+	KillWineserver bool `json:"KillWineserver"`
+	// Commands run before and after the processes of a session start and stop
+	PreStart    []CommandArgs `json:"PreStart"`
+	PostStart   []CommandArgs `json:"PostStart"`
+	PreStop     []CommandArgs `json:"PreStop"`
+	PostStop    []CommandArgs `json:"PostStop"`
+	HookTimeout int           `json:"HookTimeout"` // seconds each hook may run, defaults to 10
+	ProcessEnv
+	access *accessList
+	mu     sync.Mutex
+	Port   int
 }
 type CatCtrl struct {
-	Port    int    `json:"Port"`
-	Dialect string `json:"Dialect"`
-	Cmd     string `json:"Cmd"`
-	Args    string `json:"Args"`
+	Port    int         `json:"Port"`
+	Dialect string      `json:"Dialect"`
+	Cmd     string      `json:"Cmd"`
+	Args    CommandArgs `json:"Args"`
+	ProcessEnv
+}
+type TLS struct {
+	Port     int    `json:"Port"`
+	CertFile string `json:"CertFile"` // self-signed certificate generated when empty
+	KeyFile  string `json:"KeyFile"`
 }
 type program struct {
-	ctx context.Context
+	ctx           context.Context
+	cancel        context.CancelFunc
+	done          chan struct{}
+	journal       *journal
+	sessions      *sessionRegistry
+	levelMonitors *levelMonitors
+	queues        *waitQueues
+	resources     *resourceLocks
+	configPath    string
+	tlsConfig     *tls.Config
+	display       *displayServer // nil without a Display in the configuration
+	reloadMu      sync.Mutex     // serializes reloads, guards the fields below
+	reloads       int
+	advertised    map[*Modem][]*zeroconf.Server
+	launcherTXT   []string
+	configMu      sync.RWMutex // guards swapping Config on reload
 	*Config
 }
 
@@ -73,6 +125,10 @@ func isPortInUse(port int) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	// A dual stack listener only shows up in the IPv6 table, which may not exist
+	if tcp6Socks, err := netstat.TCP6Socks(netstat.NoopFilter); err == nil {
+		tcpSocks = append(tcpSocks, tcp6Socks...)
+	}
 	for _, s := range tcpSocks {
 		if s.LocalAddr.Port == uint16(port) && s.State == netstat.Listen {
 			return true, nil
@@ -96,57 +152,43 @@ func assertConfigFile(path string) error {
 	return nil
 }
 
-func (p *program) validateConfig() {
-	// Iterate over modems and exit if no modem is defined
-	if len(p.Modems) == 0 {
-		log.Fatal("No modems defined")
-	}
-
-	// Iterate over modems and validate that all cmd map to an existing file
-	for i := range p.Modems {
-		modem := &p.Modems[i]
-		if modem.Cmd == "" {
-			log.Fatalf("Modem executable for '%s' not defined", modem.Name)
-		} else {
-			err := assertExecutable(modem.Cmd)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-
-		if modem.Config != "" {
-			err := assertConfigFile(modem.Config)
-			if err != nil {
-				log.Fatal(err)
-			}
+// Check the configuration and look up the port of every modem. Warnings are logged,
+// errors are all returned at once.
+func validateConfig(conf *Config) error {
+	problems := checkConfig(conf)
+	for _, problem := range problems {
+		if problem.Severity == severityWarning {
+			log.Println(problem)
 		}
+	}
+	if errs := problems.errors(); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
 
-		if modem.CatCtrl.Cmd != "" {
-			err := assertExecutable(modem.CatCtrl.Cmd)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
+func (p *program) recoverConfigFiles() {
+	if p.journal == nil {
+		return
+	}
 
-		var varaDefaultConfigFile = modem.DefaultConfig
-		if varaDefaultConfigFile != "" {
-			err := assertConfigFile(varaDefaultConfigFile)
-			if err != nil {
-				log.Fatal(err)
-			}
+	var configs []string
+	for _, modem := range p.Modems {
+		if modem.Config == "" {
+			continue
 		}
-
-		// Figure out .ini file name for this modem
-		iniFilePath, err := specifiedIniConfigPath(modem, varaDefaultConfigFile)
-		if err != nil {
-			log.Fatal(err)
+		iniFilePath, err := defaultIniConfigPath(modem, modem.DefaultConfig)
+		if err == nil {
+			configs = append(configs, iniFilePath)
 		}
+	}
 
-		// Lookup port
-		modem.Port, err = GetPort(iniFilePath)
-		if err != nil {
-			log.Fatal("ERROR port number not found in " + iniFilePath)
-		}
+	recovered, err := p.journal.recover(configs)
+	if err != nil {
+		log.Println("ERROR recovering config files:", err)
+	}
+	for _, r := range recovered {
+		log.Println("Recovered from interrupted session:", r)
 	}
 }
 
@@ -170,6 +212,15 @@ func getConfigPath() (string, error) {
 	return filepath.Join(dir, name+".json"), nil
 }
 
+// Path of the configuration file in use
+func (p *program) configFilePath() string {
+	if p.configPath != "" {
+		return p.configPath
+	}
+	path, _ := getConfigPath()
+	return path
+}
+
 func getConfig(path string) (*Config, error) {
 	log.Println("Loading configuration from", path)
 	f, err := os.Open(path)
@@ -196,9 +247,59 @@ func getConfig(path string) (*Config, error) {
 		*conf.Delay = 10
 	}
 
+	if conf.KeepAlive == nil {
+		conf.KeepAlive = new(int)
+		*conf.KeepAlive = 30
+	}
+
 	return conf, nil
 }
 
+func (p *program) findModem(name string) *Modem {
+	return findModem(p.config().Modems, name)
+}
+
+func (p *program) lookupModem(name string) (*Modem, error) {
+	return lookupModem(p.config().Modems, name)
+}
+
+// Find the modem a client asked for. Names are matched exactly first, then regardless
+// of case and finally as a prefix when it matches a single modem, so "start ic705f"
+// finds IC705FM.
+func lookupModem(modems []*Modem, name string) (*Modem, error) {
+	if modem := findModem(modems, name); modem != nil {
+		return modem, nil
+	}
+
+	lower := strings.ToLower(name)
+	for _, modem := range modems {
+		if strings.ToLower(modem.Name) == lower {
+			return modem, nil
+		}
+	}
+
+	var matches []*Modem
+	if name != "" {
+		for _, modem := range modems {
+			if strings.HasPrefix(strings.ToLower(modem.Name), lower) {
+				matches = append(matches, modem)
+			}
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, &codedError{errCodeNotFound, "modem name '" + name + "' not found"}
+	case 1:
+		return matches[0], nil
+	}
+	candidates := []string{}
+	for _, modem := range matches {
+		candidates = append(candidates, modem.Name)
+	}
+	return nil, &ambiguousError{name, candidates}
+}
+
+// Find a modem by its exact name
 func findModem(modems []*Modem, name string) *Modem {
 	for _, modem := range modems {
 		if modem.Name == name {
@@ -215,6 +316,7 @@ func createCommand(multiWriter io.Writer, path string, args ...string) *exec.Cmd
 		return nil
 	}
 	cmd := exec.Command(fullPath, args...)
+	setProcessGroup(cmd)
 	cmd.Stdout = multiWriter
 	cmd.Stderr = multiWriter
 	cmd.Dir = filepath.Dir(fullPath)
@@ -225,15 +327,19 @@ func createCommand(multiWriter io.Writer, path string, args ...string) *exec.Cmd
 func defaultIniConfigPath(modem *Modem, varaDefaultConfigFile string) (string, error) {
 	// Figure out .ini file name for this modem
 	iniFilePath, _ := DefaultVaraConfigFile(modem.Cmd, varaDefaultConfigFile)
-	if !FileExists(iniFilePath) {
-		// Try args for linux implementations
-		iniFilePath, _ = DefaultVaraConfigFile(modem.Args, varaDefaultConfigFile)
-		if !FileExists(iniFilePath) {
-			log.Println("ERROR cannot find default .ini file for modem", modem.Name)
-			return "", fmt.Errorf("cannot find default .ini file for modem %s", modem.Name)
+	if FileExists(iniFilePath) {
+		return iniFilePath, nil
+	}
+	// Try args for linux implementations, e.g. wine <path to VARA.exe>
+	args, _ := modem.Args.split()
+	for _, arg := range args {
+		iniFilePath, _ = DefaultVaraConfigFile(arg, varaDefaultConfigFile)
+		if FileExists(iniFilePath) {
+			return iniFilePath, nil
 		}
 	}
-	return iniFilePath, nil
+	log.Println("ERROR cannot find default .ini file for modem", modem.Name)
+	return "", fmt.Errorf("cannot find default .ini file for modem %s", modem.Name)
 }
 
 func specifiedIniConfigPath(modem *Modem, varaDefaultConfigFile string) (string, error) {
@@ -246,285 +352,284 @@ func specifiedIniConfigPath(modem *Modem, varaDefaultConfigFile string) (string,
 }
 
 func handleConnection(conn net.Conn, p *program) {
-	var modemCmd *exec.Cmd
-	var catCtrlCmd *exec.Cmd
-	var configPath string
+	var sess *session
+	var events chan sessionEvent // nil until a session is started
+	var closed chan struct{}     // closed when the session is stopped from elsewhere
+
+	var levels chan DbfsLevel // nil until monitoring
+	var unsubscribeLevels func()
+
+	var queued chan queueResult // nil unless waiting for a busy modem
+
+	// Fires when the client sent no command for IdleTimeout seconds, a client that
+	// vanished would otherwise hold its modem forever
+	var idleTimer *time.Timer
+	var idle <-chan time.Time
+	resetIdle := func() {
+		if idleTimer != nil {
+			idleTimer.Stop()
+		}
+		idle = nil
+		if timeout := p.config().IdleTimeout; timeout > 0 {
+			idleTimer = time.NewTimer(time.Duration(timeout) * time.Second)
+			idle = idleTimer.C
+		}
+	}
+	resetIdle()
 
-	dbfsLevels := make(chan DbfsLevel, 32)
+	r := newResponder(conn)
+	auth := newAuthState(p.config().Secret, p.config().AdminSecret)
 	stop := make(chan bool)
 	cmdChannel := make(chan string)
-
-	var modem *Modem
+	disconnected := make(chan struct{})
 
 	defer func() {
 		log.Println("Cleaning up after closing connection")
 
-		if modemCmd != nil && modemCmd.Process != nil {
-			log.Println("Shutdown modem process gracefully")
-			// Gracefully shutdown process on linux and kill on windows
-			err := modemCmd.Process.Signal(syscall.SIGTERM)
-			if err != nil {
-				log.Println("Shutdown modem process gracefully failed, killing")
-				modemCmd.Process.Kill()
-			}
-			processState, err := modemCmd.Process.Wait()
-			if err != nil || processState.Success() {
-				log.Println("Warning: awaiting termination of modem process failed")
-			}
-			modemCmd.Process.Release()
-		}
-
-		if configPath != "" {
-			log.Println("Restoring original config file", configPath)
-			os.Rename(configPath+".varanny.bak", configPath)
+		if idleTimer != nil {
+			idleTimer.Stop()
 		}
 
-		if catCtrlCmd != nil && catCtrlCmd.Process != nil {
-			log.Println("Shutdown cat control process gracefully")
-			// Gracefully shutdown process on linux and kill on windows
-			err := catCtrlCmd.Process.Signal(syscall.SIGTERM)
-			if err != nil {
-				log.Println("Shutdown cat control process gracefully failed, killing")
-				catCtrlCmd.Process.Kill()
-			}
-			processState, err := catCtrlCmd.Process.Wait()
-			if err != nil || processState.Success() {
-				log.Println("Warning: awaiting termination of cat control process failed")
-			}
-			catCtrlCmd.Process.Release()
+		if sess != nil {
+			sess.close()
 		}
 
-		if modem != nil {
-			// release mutex if still locked
-			modem.mu.TryLock()
-			modem.mu.Unlock()
+		if unsubscribeLevels != nil {
+			unsubscribeLevels()
 		}
 
+		// Stops the reader goroutine, closing the
+		// connection unblocks a pending read
+		close(stop)
 		conn.Close()
 
-		stop <- true
-
-		close(dbfsLevels)
-		close(cmdChannel)
-		close(stop)
+		// A queued start always delivers a result, the modem may have been
+		// handed over just as the client left
+		if queued != nil {
+			if result := <-queued; result.sess != nil {
+				result.sess.close()
+			}
+		}
 	}()
 
-	// Start a separate goroutine to read from a TCP socket
+	// Start a separate goroutine to read commands from the TCP socket
 	go func() {
-		buffer := make([]byte, 1024)
+		defer close(disconnected)
+		reader := newCommandReader(conn)
 		for {
-			n, err := conn.Read(buffer)
+			command, err := readCommand(reader)
+			if err == errCommandTooLong {
+				r.error(errCodeCommandTooLong, "command too long")
+				continue
+			}
 			if err != nil {
 				if err == io.EOF {
 					log.Println("Client closed the connection")
 				} else {
 					log.Println(err)
 				}
-				// Prevents sending to a closed channel which causes a panic
-				select {
-				case stop <- true:
-				default:
-				}
 				return
 			}
-			cmdChannel <- strings.TrimSpace(string(buffer[:n]))
+			if command == "" {
+				continue
+			}
+			select {
+			case cmdChannel <- command:
+			case <-stop:
+				return
+			}
 		}
 	}()
 
+	// Find the modem to open a session on for this connection. Returns nil and reports
+	// the error to the client if the connection must end.
+	lookupModem := func(modemName string) *Modem {
+		if sess != nil || levels != nil || queued != nil {
+			r.error(errCodeBusy, "modem "+modemName+" is already running")
+			return nil
+		}
+		modem, err := p.lookupModem(modemName)
+		if err != nil {
+			r.fail(err, errCodeNotFound)
+			return nil
+		}
+		err = checkModemAccess(modem, conn.RemoteAddr().String())
+		if err != nil {
+			r.fail(err, errCodeForbidden)
+			return nil
+		}
+		return modem
+	}
+
+	// Start the processes of the session opened for this connection. Returns false
+	// and reports the error to the client if the connection must end.
+	startSession := func(s *session) bool {
+		sess = s
+		events = sess.events
+		closed = sess.closed
+
+		err := sess.start()
+		if err != nil {
+			// Stop the processes and restore the .ini file before reporting
+			sess.close()
+			r.error(errCodeStartFailed, err.Error())
+			return false
+		}
+		r.ok()
+		return true
+	}
+
 	for {
 		select {
-		case dbfs := <-dbfsLevels:
-			str := fmt.Sprintf("%.1f\n", dbfs.Level)
-			conn.Write([]byte(str))
+		case dbfs, ok := <-levels:
+			if !ok {
+				log.Println("Audio level monitor was stopped, closing connection")
+				return
+			}
+			r.level(dbfs.Level)
 		case command := <-cmdChannel:
-			log.Println("Received command:", command)
-			if strings.Split(command, " ")[0] == "start" {
-				// modem name could have spaces in it
-				modemName := strings.TrimPrefix(command, "start ")
-				modems := make([]*Modem, len(p.Modems))
-				for i := range p.Modems {
-					modems[i] = &p.Modems[i]
+			log.Println("Received command:", redactCommand(command))
+			resetIdle()
+			// modem name could have spaces in it
+			verb := strings.Split(command, " ")[0]
+			argument := strings.TrimPrefix(strings.TrimPrefix(command, verb), " ")
+
+			if !auth.allowed(verb) {
+				r.error(errCodeUnauthorized, "unauthorized")
+				continue
+			}
+			if sess != nil {
+				sess.touch()
+			}
+
+			switch verb {
+			case "start":
+				name, wait, timeout := parseStartArgument(p.config().Modems, argument)
+				modem := lookupModem(name)
+				if modem == nil {
+					return
 				}
-				modem = findModem(modems, modemName)
-
-				if modem != nil {
-					if modem.mu.TryLock() == false {
-						conn.Write([]byte("ERROR modem " + modemName + " is already running\n"))
-						log.Println("ERROR modem " + modemName + " is already running")
-						return
-					}
-					defer modem.mu.Unlock()
-
-					var err error
-
-					// Start cat control if defined first. No need to start VARA if cat control fails
-					if modem.CatCtrl.Cmd != "" {
-						logWriter := log.Writer()
-						multiWriter := io.MultiWriter(logWriter)
-						catCtrlCmd = createCommand(multiWriter, modem.CatCtrl.Cmd, strings.Split(modem.CatCtrl.Args, " ")...)
-
-						if catCtrlCmd != nil {
-							log.Println("Starting cat control for", modemName)
-							log.Println("Command:", catCtrlCmd.Path, catCtrlCmd.Args)
-							err = catCtrlCmd.Start()
-						}
-					}
-
-					if err == nil && modem.Cmd != "" {
-						logWriter := log.Writer()
-						multiWriter := io.MultiWriter(logWriter)
-						modemCmd = createCommand(multiWriter, modem.Cmd, modem.Args)
-
-						if modemCmd != nil {
-
-							// Swap the config file to the one defined in the modem if needed
-							if modem.Config != "" {
-
-								var varaDefaultConfigFile = modem.DefaultConfig
-								configPath, err = defaultIniConfigPath(modem, varaDefaultConfigFile)
-
-								if err != nil {
-									conn.Write([]byte("ERROR " + err.Error() + "\n"))
-									return
-								}
-								modemConfigPath := modem.Config
-
-								if modemConfigPath != configPath {
-									// Check if requested modem config exists
-									if !FileExists(modemConfigPath) {
-										log.Println("Modem config file", modemConfigPath, "does not exist")
-									} else {
-										// Make backup
-										log.Println("Backing up current config file", configPath)
-										err := CopyFile(configPath, configPath+".varanny.bak")
-										if err != nil {
-											configPath = "" // prevent restore
-											log.Println(err)
-										} else {
-											log.Println("Installing modem config file", modemConfigPath)
-											err := CopyFile(modemConfigPath, configPath)
-											if err != nil {
-												log.Println(err)
-											}
-										}
-									}
-								}
-							}
-
-							log.Println("Starting modem for", modemName)
-							log.Println("Command:", modemCmd.Path, modemCmd.Args)
-							err = modemCmd.Start()
-						}
-					}
-
-					if err != nil {
-						conn.Write([]byte("ERROR\n"))
-						log.Println(err)
-						return
-					} else {
-						// Wait until VARA has binded to its  port
-						if modem.Port != 0 {
-							for i := 0; i < 10; i++ {
-								// Check the OS to see if port is in use. Do not try to connect as VARA won't be able to rebind if
-								// we connect and close
-								found, err := isPortInUse(modem.Port)
-								if err != nil {
-									log.Println(err)
-								}
-								if found {
-									break
-								}
-								time.Sleep(1 * time.Second)
-							}
-						}
-						conn.Write([]byte("OK\n"))
-					}
-				} else {
-					conn.Write([]byte("ERROR modem name '" + modemName + "' not found\n"))
+				if wait {
+					queued = p.queueForModem(modem, conn.RemoteAddr().String(), timeout, r.queued, stop)
+					continue
+				}
+				s, err := p.openSession(modem, conn.RemoteAddr().String())
+				if err != nil {
+					r.fail(err, errCodeBusy)
 					return
 				}
-			} else {
-				if strings.Split(command, " ")[0] == "monitor" {
-					// modem name could have spaces in it
-					modemName := strings.TrimPrefix(command, "monitor ")
-					modems := make([]*Modem, len(p.Modems))
-					for i := range p.Modems {
-						modems[i] = &p.Modems[i]
-					}
-					modem = findModem(modems, modemName)
-
-					if modem != nil {
-						if modem.mu.TryLock() == false {
-							conn.Write([]byte("ERROR modem " + modemName + " is already running\n"))
-							log.Println("ERROR modem " + modemName + " is already running")
-							return
-						}
-						defer modem.mu.Unlock()
-
-						// Figure out .ini file name for this modem
-						var varaDefaultConfigFile = modem.DefaultConfig
-						iniFilePath, err := specifiedIniConfigPath(modem, varaDefaultConfigFile)
-						if err != nil {
-							conn.Write([]byte("ERROR " + err.Error() + "\n"))
-							return
-						}
-
-						audioDeviceName, err := GetInputDeviceName(iniFilePath)
-						if modem.AudioInputName != "" {
-							audioDeviceName = modem.AudioInputName
-						} else if err != nil {
-							conn.Write([]byte("ERROR audio device not found in " + iniFilePath + "\n"))
-							return
-						}
-
-						log.Println("Monitoring audio device '" + audioDeviceName + "' found in " + iniFilePath)
-						// start audio monitor
-						device, err := FindAudioDevice(audioDeviceName, p.Config.AudioInputNameThreshold)
-						if err != nil {
-							conn.Write([]byte("ERROR audio device '" + audioDeviceName + "' not found\n"))
-							return
-						}
-						conn.Write([]byte("OK\n"))
-						conn.Write([]byte(device.Name() + "\n"))
-						go Monitor(device, dbfsLevels, stop)
-					} else {
-						conn.Write([]byte("ERROR modem name '" + modemName + "' not found\n"))
-						return
-					}
-				} else {
-					switch command {
-					case "stop":
-						conn.Write([]byte("OK\n"))
-						return
-					case "version":
-						conn.Write([]byte("OK\n"))
-						conn.Write([]byte(version + "\n"))
-					case "list":
-						conn.Write([]byte("OK\n"))
-						for _, modem := range p.Modems {
-							conn.Write([]byte(modem.Name + "\n"))
-						}
-					case "config":
-						conn.Write([]byte("OK\n"))
-						configPath, _ := getConfigPath()
-						conn.Write([]byte("Config path: " + configPath + "\n"))
-						for _, modem := range p.Modems {
-							conn.Write([]byte(modem.Name + "\n"))
-							conn.Write([]byte("  Type: " + modem.Type + "\n"))
-							conn.Write([]byte("  Cmd: " + modem.Cmd + "\n"))
-							conn.Write([]byte("  Args: " + modem.Args + "\n"))
-							conn.Write([]byte("  Config: " + modem.Config + "\n"))
-							conn.Write([]byte("  CatCtrl.Port: " + strconv.Itoa(modem.CatCtrl.Port) + "\n"))
-							conn.Write([]byte("  CatCtrl.Dialect: " + modem.CatCtrl.Dialect + "\n"))
-							conn.Write([]byte("  CatCtrl.Cmd: " + modem.CatCtrl.Cmd + "\n"))
-							conn.Write([]byte("  CatCtrl.Args: " + modem.CatCtrl.Args + "\n"))
-						}
-					default:
-						conn.Write([]byte("Invalid command\n"))
-					}
+				if !startSession(s) {
+					return
 				}
+			case "monitor":
+				modem := lookupModem(argument)
+				if modem == nil {
+					return
+				}
+				var device string
+				var err error
+				levels, device, unsubscribeLevels, err = p.subscribeLevels(modem, conn.RemoteAddr().String())
+				if err != nil {
+					r.fail(err, errCodeAudioDevice)
+					return
+				}
+				r.monitor(device)
+			case "proto":
+				switch argument {
+				case "json":
+					r.setJSON(true)
+					r.proto(argument)
+				case "text":
+					r.setJSON(false)
+					r.proto(argument)
+				default:
+					r.error(errCodeInvalidProto, "unknown protocol '"+argument+"'")
+				}
+			case "challenge":
+				challenge, err := auth.newChallenge()
+				if err != nil {
+					r.fail(err, errCodeAuthFailed)
+					continue
+				}
+				r.challenge(challenge)
+			case "auth":
+				if !auth.verify(argument) {
+					// Slow down guessing
+					time.Sleep(time.Second)
+					r.error(errCodeAuthFailed, "authentication failed")
+					continue
+				}
+				r.ok()
+			case "stop":
+				// Reply once the processes are gone and the ports released
+				if sess != nil {
+					sess.close()
+				}
+				r.ok()
+				return
+			case "ping":
+				r.pong()
+			case "version":
+				r.version(version)
+			case "list":
+				names := []string{}
+				for _, modem := range p.config().Modems {
+					names = append(names, modem.Name)
+				}
+				r.list(names)
+			case "config":
+				r.config(newConfigPayload(p.configFilePath(), p.config().Modems))
+			case "sessions":
+				sessions := []*sessionPayload{}
+				for _, s := range p.sessions.list() {
+					sessions = append(sessions, newSessionPayload(s))
+				}
+				r.sessions(sessions)
+			case "kill":
+				target := p.sessions.get(argument)
+				if target == nil {
+					r.error(errCodeNotFound, "session '"+argument+"' not found")
+					continue
+				}
+				log.Println("Killing session", target.id, "for", target.modem.Name, "on request from", conn.RemoteAddr())
+				target.close()
+				r.ok()
+			case "reload":
+				err := p.reload()
+				if err != nil {
+					r.error(errCodeInvalidConfig, "reload failed: "+err.Error())
+					continue
+				}
+				r.ok()
+			default:
+				r.invalidCommand()
 			}
-		case <-stop:
+		case result := <-queued:
+			queued = nil
+			if result.err != nil {
+				r.fail(result.err, errCodeBusy)
+				return
+			}
+			if !startSession(result.sess) {
+				return
+			}
+		case event := <-events:
+			r.event(event)
+			if p.config().EndSessionOnExit {
+				log.Println("Ending session for", sess.modem.Name, "after", event.Name)
+				return
+			}
+		case <-closed:
+			log.Println("Session", sess.id, "for", sess.modem.Name, "was stopped, closing connection")
+			return
+		case <-idle:
+			if sess != nil {
+				log.Println("No activity from", conn.RemoteAddr(), "for", p.config().IdleTimeout, "seconds, ending session", sess.id, "for", sess.modem.Name)
+			} else {
+				log.Println("No activity from", conn.RemoteAddr(), "for", p.config().IdleTimeout, "seconds, closing connection")
+			}
+			return
+		case <-disconnected:
 			return
 		case <-p.ctx.Done():
 			return
@@ -532,62 +637,70 @@ func handleConnection(conn net.Conn, p *program) {
 	}
 }
 
-// Returns array of zeroconf servers
-func advertiseServices(modems []Modem, port int) (servers []*zeroconf.Server) {
-	var name string
-
+// Returns the zeroconf servers of every modem. The launcher options tell clients how
+// to reach varanny and are added to the TXT record of every modem.
+func advertiseServices(modems []*Modem, launcherOptions []string) map[*Modem][]*zeroconf.Server {
 	log.Println("Advertising DNS-SD services")
 	printMulticastInterfaces()
 
+	servers := map[*Modem][]*zeroconf.Server{}
 	for _, modem := range modems {
-		if modem.Cmd != "" {
-			options := []string{}
+		modemServers, err := advertiseModem(modem, launcherOptions)
+		if err != nil {
+			log.Println("ERROR advertising", modem.Name+":", err)
+			continue
+		}
+		servers[modem] = modemServers
+	}
+	return servers
+}
 
-			options = addOption(options, "launchport", strconv.Itoa(port))
+// Register the DNS-SD services of a single modem
+func advertiseModem(modem *Modem, launcherOptions []string) ([]*zeroconf.Server, error) {
+	var name string
+	var servers []*zeroconf.Server
 
-			if modem.CatCtrl.Port != 0 {
-				options = addOption(options, "catport", strconv.Itoa(modem.CatCtrl.Port))
-				options = addOption(options, "catdialect", modem.CatCtrl.Dialect)
-			}
+	if modem.Cmd == "" {
+		return nil, nil
+	}
+	options := append([]string{}, launcherOptions...)
 
-			// Advertise the modem based on its type
-			// TODO: Deprecate in the future when all clients have been updated
-			switch modem.Type {
-			case "fm":
-				name = "_varafm-modem._tcp"
-			case "hf":
-				name = "_varahf-modem._tcp"
-			default:
-				log.Fatal("Unknown modem type: ", modem.Type)
-			}
+	if modem.CatCtrl.Port != 0 {
+		options = addOption(options, "catport", strconv.Itoa(modem.CatCtrl.Port))
+		options = addOption(options, "catdialect", modem.CatCtrl.Dialect)
+	}
 
-			modemType := strings.ToLower(modem.Type)
-			if modemType == "hf" || modemType == "fm" {
-				options = addOption(options, "type", modemType)
-			} else {
-				log.Fatal("Unknown modem type: ", modemType)
-			}
+	// Advertise the modem based on its type
+	// TODO: Deprecate in the future when all clients have been updated
+	switch modem.Type {
+	case "fm":
+		name = "_varafm-modem._tcp"
+	case "hf":
+		name = "_varahf-modem._tcp"
+	default:
+		return nil, fmt.Errorf("Unknown modem type: %s", modem.Type)
+	}
+	options = addOption(options, "type", strings.ToLower(modem.Type))
 
-			if modem.Port != 0 {
-				// Advertise the modem using the legacy service name for backwards compatibility
-				// TODO: Deprecate in the future when all clients have been updated
-				legacyServiceNameServer, err := zeroconf.Register(modem.Name, name, "local.", modem.Port, options, nil)
-				if err != nil {
-					log.Fatal(err)
-				}
-				servers = append(servers, legacyServiceNameServer)
+	if modem.Port == 0 {
+		return nil, fmt.Errorf("Port not found for modem %s", modem.Name)
+	}
 
-				server, err := zeroconf.Register(modem.Name, "_vara-modem._tcp", "local.", modem.Port, options, nil)
-				if err != nil {
-					log.Fatal(err)
-				}
-				servers = append(servers, server)
-			} else {
-				log.Fatal("Port not found for modem", modem.Name)
-			}
-		}
+	// Advertise the modem using the legacy service name for backwards compatibility
+	// TODO: Deprecate in the future when all clients have been updated
+	legacyServiceNameServer, err := zeroconf.Register(modem.Name, name, "local.", modem.Port, options, nil)
+	if err != nil {
+		return nil, err
 	}
-	return servers
+	servers = append(servers, legacyServiceNameServer)
+
+	server, err := zeroconf.Register(modem.Name, "_vara-modem._tcp", "local.", modem.Port, options, nil)
+	if err != nil {
+		legacyServiceNameServer.Shutdown()
+		return nil, err
+	}
+	servers = append(servers, server)
+	return servers, nil
 }
 
 // Print out all the broadcast network interfaces
@@ -609,46 +722,144 @@ func printMulticastInterfaces() {
 	log.Println("Multicast network interfaces:", interfaces)
 }
 
-func (p *program) run() {
-	servers := advertiseServices(p.Modems, p.Port)
-	defer func() {
-		for _, server := range servers {
-			server.Shutdown()
+// TXT options advertising the launcher ports and, for TLS, the certificate
+// fingerprint clients can pin
+func (p *program) launcherOptions() []string {
+	conf := p.config()
+	options := []string{}
+	if conf.Port != 0 {
+		options = addOption(options, "launchport", strconv.Itoa(conf.Port))
+	}
+	if p.tlsConfig != nil {
+		options = addOption(options, "tlsport", strconv.Itoa(conf.TLS.Port))
+		options = addOption(options, "tlsfingerprint", certificateFingerprint(p.tlsConfig.Certificates[0]))
+	}
+	return options
+}
+
+// Load the certificate of the TLS listener, if one is configured
+func (p *program) loadTLSConfig() error {
+	conf := p.config()
+	if conf.TLS.Port == 0 {
+		return nil
+	}
+
+	certFile, keyFile := conf.TLS.CertFile, conf.TLS.KeyFile
+	if certFile == "" && keyFile == "" {
+		certFile, keyFile = selfSignedPaths(p.configPath)
+	} else if certFile == "" || keyFile == "" {
+		return fmt.Errorf("TLS requires both CertFile and KeyFile")
+	}
+
+	cert, err := loadOrCreateCertificate(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	log.Println("TLS certificate fingerprint", certificateFingerprint(cert))
+	p.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return nil
+}
+
+// Listen for control connections. TCP keepalive probes, sent every keepAlive seconds,
+// detect clients that vanished without closing the connection.
+func listen(port int, keepAlive int) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: time.Duration(keepAlive) * time.Second}
+	if keepAlive == 0 {
+		lc.KeepAlive = -1 // disabled
+	}
+	return lc.Listen(context.Background(), "tcp", ":"+strconv.Itoa(port))
+}
+
+// Accept connections until the listener is closed on shutdown
+func (p *program) serve(ln net.Listener, connections *sync.WaitGroup) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if p.ctx.Err() != nil {
+				return
+			}
+			log.Fatal(err)
 		}
-	}()
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			if !p.admit(conn) {
+				return
+			}
+			log.Println("New connection from", conn.RemoteAddr())
+			handleConnection(conn, p)
+		}()
+	}
+}
 
-	// Start the launcher server
-	portStr := strconv.Itoa(p.Port)
-	ln, err := net.Listen("tcp", ":"+portStr)
+func (p *program) run() {
+	err := p.loadTLSConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println("Listening on", ln.Addr())
-	log.Println("Waiting for connections...")
 
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				log.Fatal(err)
-			}
-			go func() {
-				log.Println("New connection")
-				handleConnection(conn, p)
-			}()
+	conf := p.config()
+
+	p.reloadMu.Lock()
+	p.launcherTXT = p.launcherOptions()
+	p.advertised = advertiseServices(conf.Modems, p.launcherTXT)
+	p.reloadMu.Unlock()
+	defer p.withdrawServices()
+
+	// Start the launcher server, plaintext for legacy clients and TLS if configured
+	var listeners []net.Listener
+	if conf.Port != 0 || p.tlsConfig == nil {
+		ln, err := listen(conf.Port, *conf.KeepAlive)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}()
+		log.Println("Listening on", ln.Addr())
+		listeners = append(listeners, ln)
+	}
+	if p.tlsConfig != nil {
+		ln, err := listen(conf.TLS.Port, *conf.KeepAlive)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ln = tls.NewListener(ln, p.tlsConfig)
+		log.Println("Listening with TLS on", ln.Addr())
+		listeners = append(listeners, ln)
+	}
+	log.Println("Waiting for connections...")
+
+	if conf.HttpPort != 0 {
+		go p.serveHTTP()
+	}
+
+	go p.watchReloadSignal()
 
-	select {
-	case <-p.ctx.Done():
+	// Track open connections so shutdown waits for their cleanup
+	var connections sync.WaitGroup
+
+	for _, ln := range listeners {
+		go p.serve(ln, &connections)
+	}
+
+	<-p.ctx.Done()
+	for _, ln := range listeners {
 		ln.Close()
-		return
+	}
+	connections.Wait()
+
+	// Sessions that are not tied to a connection, e.g. started over HTTP
+	for _, s := range p.sessions.list() {
+		s.close()
 	}
 }
 
 func main() {
 	configFlag := flag.String("config", "", "Path to the configuration file.")
 	versionFlag := flag.Bool("version", false, "Print version and exit.")
+	checkFlag := flag.Bool("check-config", false, "Check the configuration file, print the problems found and exit.")
+	serviceFlag := flag.String("service", "", "Control the system service: "+strings.Join(serviceActions, ", ")+".")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
@@ -674,35 +885,59 @@ func main() {
 		}
 	}
 
-	config, err := getConfig(configPath)
+	configPath, err := filepath.Abs(configPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if *checkFlag {
+		os.Exit(runConfigCheck(configPath, os.Stdout))
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	prg := &program{
-		ctx:    ctx,
-		Config: config,
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+		journal:       newJournal(journalPath(configPath)),
+		sessions:      newSessionRegistry(),
+		levelMonitors: newLevelMonitors(),
+		queues:        newWaitQueues(),
+		resources:     newResourceLocks(),
+		configPath:    configPath,
 	}
 
-	prg.validateConfig()
+	s, err := service.New(prg, newServiceConfig(configPath))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Intercept SIGINT and SIGTERM to allow for graceful shutdown
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		<-c
-		log.Println("Shutting down...")
-		cancel()
-	}()
+	if len(*serviceFlag) != 0 {
+		err := controlService(s, *serviceFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	log.Println("Starting varanny", version)
-	if *config.Delay > 0 {
-		log.Println("  Delaying startup for", *config.Delay, "seconds")
-		log.Println("  (if this is unwanted, set Delay to 0 in the config file)")
+	prg.Config, err = getConfig(configPath)
+	if err != nil {
+		log.Fatal(err, configSyntaxHint(err))
 	}
 
-	time.Sleep(time.Duration(*config.Delay) * time.Second)
+	// Put back original .ini files left swapped by an interrupted session
+	prg.recoverConfigFiles()
+
+	err = validateConfig(prg.Config)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	prg.display = newDisplayServer(prg.Config.Display)
 
-	prg.run()
+	// Run interactively or under the service manager. SIGINT and SIGTERM
+	// are intercepted by the service package and end up calling Stop.
+	err = s.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
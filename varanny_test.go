@@ -71,6 +71,46 @@ func TestCreateCommand(t *testing.T) {
 	}
 }
 
+func TestLookupModem(t *testing.T) {
+	modems := []*Modem{{Name: "IC705FM"}, {Name: "IC705HF"}, {Name: "IC"}, {Name: "Digirig FM"}}
+
+	cases := map[string]string{
+		"IC705FM":    "IC705FM",
+		"ic705fm":    "IC705FM",
+		"ic705h":     "IC705HF",
+		"IC":         "IC",
+		"digirig":    "Digirig FM",
+		"DIGIRIG FM": "Digirig FM",
+	}
+	for name, want := range cases {
+		modem, err := lookupModem(modems, name)
+		if err != nil {
+			t.Errorf("lookupModem(%q) failed: %v", name, err)
+			continue
+		}
+		if modem.Name != want {
+			t.Errorf("lookupModem(%q) = %q, want %q", name, modem.Name, want)
+		}
+	}
+
+	_, err := lookupModem(modems, "ic7")
+	if e, ok := err.(*ambiguousError); !ok || len(e.candidates) != 2 {
+		t.Fatalf("expected ambiguous error with 2 candidates, got %v", err)
+	}
+	if err.Error() != "ambiguous modem name 'ic7', candidates: IC705FM, IC705HF" {
+		t.Fatalf("unexpected message %q", err.Error())
+	}
+
+	_, err = lookupModem(modems, "FT-991")
+	if errorCode(err, "") != errCodeNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	_, err = lookupModem(modems, "")
+	if errorCode(err, "") != errCodeNotFound {
+		t.Fatalf("expected empty name not to match, got %v", err)
+	}
+}
+
 func TestMain(m *testing.M) {
 	// Do setup here
 	code := m.Run()